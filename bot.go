@@ -2,13 +2,21 @@ package fbbot
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/michlabs/fbbot/memory"
 	"github.com/sirupsen/logrus"
@@ -16,44 +24,72 @@ import (
 
 type Bot struct {
 	// User defined fields
-	Page            Page // TODO: How to find out it?
-	port            int
-	verifyToken     string
-	appSecret       string
-	pageAccessToken string
-	greeting_text   string
+	Page          Page // TODO: How to find out it?
+	port          int
+	verifyToken   string
+	appSecret     string
+	tokens        TokenProvider // provides the page access token
+	greeting_text string
 
 	// Handler
 	messageHandlers        []MessageHandler
 	postbackHandlers       []PostbackHandler
 	deliveryHandlers       []DeliveryHandler
 	optinHandlers          []OptinHandler
+	referralHandlers       []ReferralHandler
 	readHandlers           []ReadHandler
 	echoHandlers           []EchoHandler
 	checkoutUpdateHandlers []CheckoutUpdateHandler
 	paymentHandlers        []PaymentHandler
 
+	Profiles *ProfileService // Profiles fetches and caches user profiles
+
 	LTMemory memory.Memory // LTMemory will be persit across conversation
 	STMemory memory.Memory // STMemory will be cleared for the user at the end of conversation
 
+	// Pages served by this bot's webhook, see AddPage
+	pagesMutex sync.RWMutex
+	pages      map[string]*Bot
+	instagram  map[string]string // maps an Instagram account ID to the ID of its page, see AddInstagramAccount
+
+	// MaxBodyBytes limits size of webhook request bodies, larger requests are rejected
+	MaxBodyBytes int64
+
+	// AllowSHA1Signature accepts requests signed only by the SHA-1 X-Hub-Signature header,
+	// for apps whose webhooks do not send X-Hub-Signature-256 yet.
+	AllowSHA1Signature bool
+
 	// Framework
-	Logger *logrus.Logger
-	mux    *http.ServeMux
+	Logger   *logrus.Logger // Logger redacts secrets of the bot, see RedactHook
+	redactor *redactor
+	Server   *http.Server // Server serves the webhook, its timeouts can be changed before Run
+	mux      *http.ServeMux
 }
 
 func New(port int, verifyToken string, appSecret string, pageAccessToken string) *Bot {
 	var b Bot = Bot{
-		port:            port,
-		verifyToken:     verifyToken,
-		appSecret:       appSecret,
-		pageAccessToken: pageAccessToken,
-		mux:             http.NewServeMux(),
-		Logger:          logrus.New(),
-	}
+		port:         port,
+		verifyToken:  verifyToken,
+		appSecret:    appSecret,
+		tokens:       StaticToken(pageAccessToken),
+		redactor:     newRedactor(),
+		MaxBodyBytes: DefaultMaxBodyBytes,
+		mux:          http.NewServeMux(),
+		Logger:       logrus.New(),
+	}
+	b.Logger.AddHook(b.redactor)
+	b.redactor.add(verifyToken, appSecret)
 	b.mux.HandleFunc(WebhookURL, b.handle)
+	b.Server = &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      b.mux,
+		ReadTimeout:  DefaultReadTimeout,
+		WriteTimeout: DefaultWriteTimeout,
+		IdleTimeout:  DefaultIdleTimeout,
+	}
 	b.LTMemory = memory.New("ephemeral")
 	b.STMemory = memory.New("ephemeral")
-	bot = &b // For using outside of bot methods (User struct)
+	b.Profiles = NewProfileService(&b)
 	return &b
 }
 
@@ -63,14 +99,29 @@ func (b *Bot) verify(w http.ResponseWriter, r *http.Request) {
 		b.Logger.Info("Verified")
 		return
 	}
-	b.Logger.WithFields(logrus.Fields{"verifyToken": b.verifyToken, "hub.verify_token": r.FormValue("hub.verify_token")}).Error("Failed to validate. Make sure the validation tokens match.")
+	b.Logger.Error("Failed to validate. Make sure the validation tokens match.")
 	http.Error(w, "Failed validation. Make sure the validation tokens match.", http.StatusForbidden)
 	return
 }
 
 func (b *Bot) Run() {
-	if err := b.Subscribe(); err != nil {
-		b.Logger.Warn("Failed to subscribe to the page")
+	if token, err := b.tokens.Token(); err != nil || token != "" {
+		if err := b.CheckToken(); err != nil {
+			b.Logger.WithFields(logrus.Fields{"error": err}).Warn("Page access token check failed")
+		}
+		if err := b.Subscribe(); err != nil {
+			b.Logger.Warn("Failed to subscribe to the page")
+		}
+	}
+	for _, id := range b.Pages() {
+		if p, ok := b.PageBot(id); ok {
+			if err := p.CheckToken(); err != nil {
+				b.Logger.WithFields(logrus.Fields{"page": id, "error": err}).Warn("Page access token check failed")
+			}
+			if err := p.Subscribe(); err != nil {
+				b.Logger.WithField("page", id).Warn("Failed to subscribe to the page")
+			}
+		}
 	}
 	if len(b.messageHandlers) == 0 {
 		b.Logger.Warn("Message Handler is missing")
@@ -98,7 +149,7 @@ func (b *Bot) Run() {
 	}
 
 	b.Logger.Infof("Bot is running at :%d%s", b.port, WebhookURL)
-	b.Logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", b.port), b.mux))
+	b.Logger.Fatal(b.Server.ListenAndServe())
 }
 
 func (b *Bot) AddMessageHandler(h MessageHandler) {
@@ -117,6 +168,10 @@ func (b *Bot) AddOptinHandler(h OptinHandler) {
 	b.optinHandlers = append(b.optinHandlers, h)
 }
 
+func (b *Bot) AddReferralHandler(h ReferralHandler) {
+	b.referralHandlers = append(b.referralHandlers, h)
+}
+
 func (b *Bot) AddReadHandler(h ReadHandler) {
 	b.readHandlers = append(b.readHandlers, h)
 }
@@ -140,19 +195,26 @@ func (b *Bot) handle(w http.ResponseWriter, r *http.Request) {
 	}
 	if r.Method == "POST" {
 		// Handle callback
-		body, err := ioutil.ReadAll(r.Body)
+		// Read one byte more than the limit to tell a too large body from other read errors
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, b.MaxBodyBytes+1))
 		if err != nil {
-			b.Logger.Error("Failed to read resquest body")
-			http.Error(w, "Failed to read resquest body", http.StatusInternalServerError)
+			b.Logger.WithFields(logrus.Fields{"error": err}).Error("Failed to read resquest body")
+			http.Error(w, "Failed to read resquest body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > b.MaxBodyBytes {
+			b.Logger.WithFields(logrus.Fields{"limit": b.MaxBodyBytes}).Error("Request body is too large")
+			http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
 			return
 		}
-		b.Logger.WithFields(logrus.Fields{"request": string(body)}).Debug("New request:")
 
 		// Verify message signature
-		if !b.verifySignature(body, r.Header.Get("X-Hub-Signature")[5:]) {
+		if !b.verifySignature(body, r.Header) {
 			b.Logger.Error("invalid request signature")
+			http.Error(w, "Invalid request signature", http.StatusForbidden)
 			return
 		}
+		b.Logger.WithFields(logrus.Fields{"request": string(body)}).Debug("New request:")
 
 		var msg rawCallbackMessage
 		if err := json.Unmarshal(body, &msg); err != nil {
@@ -162,7 +224,11 @@ func (b *Bot) handle(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Try to return a 200 OK HTTP as fast as possible
-		go b.process(msg.Unbox())
+		for _, entry := range msg.RawEntries {
+			platform := platformOf(msg.RawObject)
+			pb := b.routeEntry(entry.RawID, platform)
+			go pb.process(entry.Unbox(pb, platform))
+		}
 
 		return
 	}
@@ -196,6 +262,10 @@ func (b *Bot) process(messages []interface{}) {
 			for _, h := range b.optinHandlers {
 				go h.HandleOptin(b, m)
 			}
+		case *Referral:
+			for _, h := range b.referralHandlers {
+				go h.HandleReferral(b, m)
+			}
 		case *Read:
 			for _, h := range b.readHandlers {
 				go h.HandleRead(b, m)
@@ -216,6 +286,9 @@ func (b *Bot) process(messages []interface{}) {
 
 // TODO: Support other message types
 func (b *Bot) Send(r User, m interface{}) error {
+	if !r.Platform().supports(m) {
+		return ErrNotSupported
+	}
 	switch m := m.(type) {
 	case *TextMessage:
 		return b.sendTextMessage(r, m)
@@ -244,7 +317,7 @@ func (b *Bot) sendTextMessage(r User, m *TextMessage) error {
 	data["recipient"] = map[string]string{"id": r.ID}
 	data["message"] = map[string]string{"text": m.Text}
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -277,7 +350,7 @@ func (b *Bot) sendImageMessage(r User, m *ImageMessage) error {
 	data["message"] = message
 	data["notification_type"] = m.Noti
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 	}
@@ -302,7 +375,7 @@ func (b *Bot) sendButtonMessage(r User, m *ButtonMessage) error {
 	data["recipient"] = map[string]string{"id": r.ID}
 	data["message"] = map[string]interface{}{"attachment": attachment}
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -326,7 +399,7 @@ func (b *Bot) sendGenericMessage(r User, m *GenericMessage) error {
 	data["recipient"] = map[string]string{"id": r.ID}
 	data["message"] = map[string]interface{}{"attachment": attachment}
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -341,7 +414,7 @@ func (b *Bot) sendQuickRepliesMessage(r User, m *QuickRepliesMessage) error {
 	data["recipient"] = map[string]string{"id": r.ID}
 	data["message"] = m
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.Errorf("Failed to send message. Error: %s\nData:%#v", err.Error(), data)
 		return err
@@ -356,7 +429,7 @@ func (b *Bot) TypingOn(r User) error {
 	data["recipient"] = r
 	data["sender_action"] = "typing_on"
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -371,7 +444,7 @@ func (b *Bot) TypingOff(r User) error {
 	data["recipient"] = r
 	data["sender_action"] = "typing_off"
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -385,7 +458,7 @@ func (b *Bot) MarkSeen(r User) error {
 	data["recipient"] = r
 	data["sender_action"] = "mark_seen"
 
-	_, err := b.httppost(SendAPIEndpoint, data)
+	_, err := b.send(r, data)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"data": data, "error": err}).Error("Failed to send message")
 		return err
@@ -394,6 +467,14 @@ func (b *Bot) MarkSeen(r User) error {
 	return nil
 }
 
+// send posts data to the Send API, dropping fields the recipient's platform does not accept.
+func (b *Bot) send(r User, data map[string]interface{}) ([]byte, error) {
+	if r.Platform() == PlatformInstagram {
+		delete(data, "notification_type")
+	}
+	return b.httppost(SendAPIEndpoint, data)
+}
+
 // Subscribe subscribes this bot to get updates for the page.
 func (b *Bot) Subscribe() error {
 	data := make(map[string]interface{})
@@ -456,15 +537,40 @@ func (b *Bot) RemoveGreetingText() error {
 }
 
 func (b *Bot) httppost(url string, data map[string]interface{}) ([]byte, error) {
-	url = fmt.Sprintf("%s?access_token=%s", url, b.pageAccessToken)
+	return b.httprequest("POST", url, data)
+}
+
+func (b *Bot) httpget(url string) ([]byte, error) {
+	return b.httprequest("GET", url, nil)
+}
 
-	d, err := json.Marshal(data)
+func (b *Bot) httpdelete(url string, data map[string]interface{}) ([]byte, error) {
+	return b.httprequest("DELETE", url, data)
+}
+
+// httprequest sends a Graph API request authenticated by the page access token.
+// url may already contain a query string.
+func (b *Bot) httprequest(method string, url string, data map[string]interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if data != nil {
+		d, err := json.Marshal(data)
+		if err != nil {
+			b.Logger.WithFields(logrus.Fields{"data": data}).Error("Failed to marshal")
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(d)
+	}
+
+	req, err := b.newRequest(context.Background(), method, url, reqBody)
 	if err != nil {
-		b.Logger.WithFields(logrus.Fields{"data": data}).Error("Failed to marshal")
+		b.Logger.WithFields(logrus.Fields{"error": err}).Error("Failed to create request")
 		return nil, err
 	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(d))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		b.Logger.WithFields(logrus.Fields{"URL": url, "data": data}).Error("Failed to request")
 		return nil, err
@@ -486,53 +592,34 @@ func (b *Bot) httppost(url string, data map[string]interface{}) ([]byte, error)
 	return body, nil
 }
 
-func (b *Bot) fetchUserData(u *User) {
-	uri := fmt.Sprintf("%s/%s?fields=first_name,last_name,profile_pic,locale,timezone,gender&access_token=%s", APIEndpoint, u.ID, b.pageAccessToken)
-	b.Logger.Debug("fetchUserData", uri)
+// fetchProfile requests the profile of the user from the Graph API.
+func (b *Bot) fetchProfile(ctx context.Context, userID string) (Profile, error) {
+	var p Profile
+	uri := fmt.Sprintf("%s/%s?fields=first_name,last_name,profile_pic,locale,timezone,gender", APIEndpoint, userID)
 
-	resp, err := http.Get(uri)
+	req, err := b.newRequest(ctx, "GET", uri, nil)
 	if err != nil {
-		b.Logger.Error("failed to fetch user data: ", err)
-		return
+		return p, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return p, fmt.Errorf("failed to fetch user profile: %v", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		b.Logger.Error("failed to read response data")
-		return
+		return p, fmt.Errorf("failed to read user profile: %v", err)
 	}
 
 	if resp.StatusCode != 200 {
-		b.Logger.Error("failed to fetch user data: ", string(body))
-		return
+		return p, fmt.Errorf("failed to fetch user profile. Response code: %d. Body: %s", resp.StatusCode, string(body))
 	}
 
-	var tmp struct {
-		FirstName        string  `json:"first_name, omitempty"`
-		LastName         string  `json:"last_name, omitempty"`
-		ProfilePic       string  `json:"profile_pic, omitempty"`
-		Locale           string  `json:"locale, omitempty"`
-		Timezone         float32 `json:"timezone, omitempty"`
-		Gender           string  `json:"gender, omitempty"`
-		IsPaymentEnabled bool    `json:"is_payment_enabled, omitempty"` // Is the user eligible to receive messenger platform payment messages
-	}
-
-	if err := json.Unmarshal(body, &tmp); err != nil {
-		b.Logger.Error("failed to unmarshal response: ", err)
-		return
+	if err := json.Unmarshal(body, &p); err != nil {
+		return p, fmt.Errorf("failed to unmarshal user profile: %v", err)
 	}
-
-	u.firstName = tmp.FirstName
-	u.lastName = tmp.LastName
-	u.profilePic = tmp.ProfilePic
-	u.locale = tmp.Locale
-	u.timezone = tmp.Timezone
-	u.gender = tmp.Gender
-	u.isPaymentEnabled = tmp.IsPaymentEnabled
-	u.isFetched = true
-
-	return
+	return p, nil
 }
 
 // EnableGetStarted enables the Get Started button at the first conversation
@@ -554,14 +641,106 @@ func (b *Bot) AddPersistentMenus(menus ...*Menu) error {
 	return err
 }
 
-func (b *Bot) verifySignature(content []byte, signature string) bool {
-	if signature == "" {
+// SetUserMenu sets a persistent menu for a single user, overriding the page-level menu
+// set by AddPersistentMenus for that user only.
+func (b *Bot) SetUserMenu(u User, menus ...*Menu) error {
+	data := make(map[string]interface{})
+	data["psid"] = u.ID
+	data["persistent_menu"] = menus
+	_, err := b.httppost(CustomUserSettingsEndpoint, data)
+	return err
+}
+
+// GetUserMenu returns the persistent menu set for the user by SetUserMenu.
+// It returns an empty slice if the user has no menu of its own.
+func (b *Bot) GetUserMenu(u User) ([]*Menu, error) {
+	uri := fmt.Sprintf("%s?psid=%s", CustomUserSettingsEndpoint, url.QueryEscape(u.ID))
+	body, err := b.httpget(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Data []struct {
+			UserLevelPersistentMenu []*Menu `json:"user_level_persistent_menu"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var menus []*Menu
+	for _, d := range resp.Data {
+		menus = append(menus, d.UserLevelPersistentMenu...)
+	}
+	return menus, nil
+}
+
+// ResetUserMenu removes the user's own persistent menu,
+// so the user sees the page-level menu again.
+func (b *Bot) ResetUserMenu(u User) error {
+	uri := fmt.Sprintf("%s?psid=%s&params=%s", CustomUserSettingsEndpoint, url.QueryEscape(u.ID), url.QueryEscape(`["persistent_menu"]`))
+	_, err := b.httpdelete(uri, nil)
+	return err
+}
+
+// newRequest creates a Graph API request authenticated by the page access token.
+// The token is sent in the Authorization header, never in the URL,
+// and its appsecret_proof is added to the query string if the app secret is set.
+func (b *Bot) newRequest(ctx context.Context, method string, uri string, body io.Reader) (*http.Request, error) {
+	token, err := b.tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page access token: %v", err)
+	}
+	b.redactor.add(token)
+
+	if b.appSecret != "" {
+		sep := "?"
+		if strings.Contains(uri, "?") {
+			sep = "&"
+		}
+		proof := b.appSecretProof(token)
+		b.redactor.add(proof)
+		uri = fmt.Sprintf("%s%sappsecret_proof=%s", uri, sep, proof)
+	}
+
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req.WithContext(ctx), nil
+}
+
+// appSecretProof returns the SHA-256 HMAC of the access token keyed by the app secret.
+func (b *Bot) appSecretProof(accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(b.appSecret))
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the X-Hub-Signature-256 header of a webhook request,
+// falling back to the SHA-1 X-Hub-Signature header if it is missing and AllowSHA1Signature is set.
+func (b *Bot) verifySignature(content []byte, header http.Header) bool {
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		return b.checkMAC(sha256.New, "sha256=", content, signature)
+	}
+	if signature := header.Get("X-Hub-Signature"); signature != "" && b.AllowSHA1Signature {
+		return b.checkMAC(sha1.New, "sha1=", content, signature)
+	}
+	return false
+}
+
+// checkMAC compares the signature in form of "<prefix><hex digest>" with HMAC of the content in constant time.
+func (b *Bot) checkMAC(h func() hash.Hash, prefix string, content []byte, signature string) bool {
+	if !strings.HasPrefix(signature, prefix) {
 		return false
 	}
-	mac := hmac.New(sha1.New, []byte(b.appSecret))
-	mac.Write(content)
-	if fmt.Sprintf("%x", mac.Sum(nil)) != signature {
+	expected, err := hex.DecodeString(signature[len(prefix):])
+	if err != nil {
 		return false
 	}
-	return true
+	mac := hmac.New(h, []byte(b.appSecret))
+	mac.Write(content)
+	return hmac.Equal(mac.Sum(nil), expected)
 }
@@ -0,0 +1,222 @@
+package fbbot
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func sign(h func() hash.Hash, prefix string, secret string, body string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(body))
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestBot() *Bot {
+	b := New(0, "verify", "secret", "token")
+	b.Logger.SetOutput(ioutil.Discard)
+	b.Logger.SetLevel(logrus.PanicLevel)
+	return b
+}
+
+// recordingTransport answers Graph API requests with Response, "{}" if empty, and records them.
+type recordingTransport struct {
+	Status   int // 200 if zero
+	Response string
+
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+	t.mutex.Lock()
+	t.requests = append(t.requests, req)
+	t.bodies = append(t.bodies, string(body))
+	t.mutex.Unlock()
+
+	status, response := t.Status, t.Response
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if response == "" {
+		response = "{}"
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(response)), Request: req}, nil
+}
+
+// sent returns the bodies of the recorded requests.
+func (t *recordingTransport) sent() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string(nil), t.bodies...)
+}
+
+// useTransport makes Graph API requests go through rt and returns the function restoring the transport.
+func useTransport(rt http.RoundTripper) func() {
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = rt
+	return func() { http.DefaultClient.Transport = old }
+}
+
+func TestVerifySignature(t *testing.T) {
+	b := newTestBot()
+	body := `{"object":"page","entry":[]}`
+	tests := []struct {
+		name      string
+		allowSHA1 bool
+		header    map[string]string
+		want      bool
+	}{
+		{"sha256", false, map[string]string{"X-Hub-Signature-256": sign(sha256.New, "sha256=", "secret", body)}, true},
+		{"sha1 rejected by default", false, map[string]string{"X-Hub-Signature": sign(sha1.New, "sha1=", "secret", body)}, false},
+		{"sha1 allowed", true, map[string]string{"X-Hub-Signature": sign(sha1.New, "sha1=", "secret", body)}, true},
+		{"sha1 allowed wrong secret", true, map[string]string{"X-Hub-Signature": sign(sha1.New, "sha1=", "wrong", body)}, false},
+		{"sha256 preferred", true, map[string]string{
+			"X-Hub-Signature-256": sign(sha256.New, "sha256=", "wrong", body),
+			"X-Hub-Signature":     sign(sha1.New, "sha1=", "secret", body),
+		}, false},
+		{"wrong secret", false, map[string]string{"X-Hub-Signature-256": sign(sha256.New, "sha256=", "wrong", body)}, false},
+		{"wrong prefix", false, map[string]string{"X-Hub-Signature-256": sign(sha256.New, "sha1=", "secret", body)}, false},
+		{"not hex", false, map[string]string{"X-Hub-Signature-256": "sha256=zz"}, false},
+		{"missing", true, nil, false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		for k, v := range tt.header {
+			header.Set(k, v)
+		}
+		b.AllowSHA1Signature = tt.allowSHA1
+		if got := b.verifySignature([]byte(body), header); got != tt.want {
+			t.Errorf("%s: verifySignature() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestHandleStatusCodes(t *testing.T) {
+	b := newTestBot()
+	b.MaxBodyBytes = 64
+	small := `{"object":"page","entry":[]}`
+	large := `{"object":"page","entry":[],"padding":"` + strings.Repeat("x", 64) + `"}`
+
+	tests := []struct {
+		name      string
+		body      func() *http.Request
+		signature string
+		want      int
+	}{
+		{"valid", func() *http.Request { return httptest.NewRequest("POST", WebhookURL, strings.NewReader(small)) },
+			sign(sha256.New, "sha256=", "secret", small), http.StatusOK},
+		{"invalid signature", func() *http.Request { return httptest.NewRequest("POST", WebhookURL, strings.NewReader(small)) },
+			sign(sha256.New, "sha256=", "wrong", small), http.StatusForbidden},
+		{"too large", func() *http.Request { return httptest.NewRequest("POST", WebhookURL, strings.NewReader(large)) },
+			sign(sha256.New, "sha256=", "secret", large), http.StatusRequestEntityTooLarge},
+		{"read error", func() *http.Request { return httptest.NewRequest("POST", WebhookURL, failingReader{}) },
+			"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := tt.body()
+		r.Header.Set("X-Hub-Signature-256", tt.signature)
+		w := httptest.NewRecorder()
+		b.handle(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestSetUserMenu(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	menu := NewMenu()
+	menu.AddMenuItems(NewPostbackMenuItem("Help", "HELP"))
+	if err := newTestBot().SetUserMenu(User{ID: "42"}, menu); err != nil {
+		t.Fatalf("SetUserMenu() = %v", err)
+	}
+
+	if len(transport.requests) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(transport.requests))
+	}
+	req := transport.requests[0]
+	if req.Method != "POST" || !strings.HasPrefix(req.URL.String(), CustomUserSettingsEndpoint) {
+		t.Errorf("request = %s %s, want POST %s", req.Method, req.URL, CustomUserSettingsEndpoint)
+	}
+	var body struct {
+		PSID           string  `json:"psid"`
+		PersistentMenu []*Menu `json:"persistent_menu"`
+	}
+	if err := json.Unmarshal([]byte(transport.sent()[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.PSID != "42" || len(body.PersistentMenu) != 1 || body.PersistentMenu[0].CallToActions[0].Payload != "HELP" {
+		t.Errorf("body = %s", transport.sent()[0])
+	}
+}
+
+func TestGetUserMenu(t *testing.T) {
+	transport := &recordingTransport{Response: `{"data":[{"user_level_persistent_menu":[
+		{"locale":"default","call_to_actions":[{"title":"Help","type":"postback","payload":"HELP"}]}]}]}`}
+	defer useTransport(transport)()
+
+	menus, err := newTestBot().GetUserMenu(User{ID: "42"})
+	if err != nil {
+		t.Fatalf("GetUserMenu() = %v", err)
+	}
+	if len(menus) != 1 || menus[0].Locale != "default" || menus[0].CallToActions[0].Payload != "HELP" {
+		t.Errorf("GetUserMenu() = %+v", menus)
+	}
+	req := transport.requests[0]
+	if req.Method != "GET" || req.URL.Query().Get("psid") != "42" {
+		t.Errorf("request = %s %s, want GET with psid=42", req.Method, req.URL)
+	}
+
+	transport.Response = `{"data":[]}`
+	if menus, err := newTestBot().GetUserMenu(User{ID: "42"}); err != nil || len(menus) != 0 {
+		t.Errorf("GetUserMenu() without a menu = %+v, %v, want none", menus, err)
+	}
+
+	transport.Status, transport.Response = http.StatusBadRequest, `{"error":{"message":"no such user"}}`
+	if _, err := newTestBot().GetUserMenu(User{ID: "42"}); err == nil {
+		t.Error("GetUserMenu() of a failed request = nil error, want an error")
+	}
+}
+
+func TestResetUserMenu(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	if err := newTestBot().ResetUserMenu(User{ID: "42"}); err != nil {
+		t.Fatalf("ResetUserMenu() = %v", err)
+	}
+	req := transport.requests[0]
+	query := req.URL.Query()
+	if req.Method != "DELETE" || query.Get("psid") != "42" || query.Get("params") != `["persistent_menu"]` {
+		t.Errorf("request = %s %s, want DELETE of the user's persistent_menu", req.Method, req.URL)
+	}
+
+	transport.Status = http.StatusBadRequest
+	if err := newTestBot().ResetUserMenu(User{ID: "42"}); err == nil {
+		t.Error("ResetUserMenu() of a failed request = nil error, want an error")
+	}
+}
@@ -1,6 +1,12 @@
 package fbbot
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/michlabs/fbbot/memory"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -10,6 +16,26 @@ type Event string
 const ResetEvent Event = "reset"
 const NilEvent Event = ""
 
+// DoneEvent is the result of a sub-dialog whose end step emits no event when entered.
+const DoneEvent Event = "done"
+
+// DefaultMaxTransitions is the number of transitions a dialog follows for an input if its MaxTransitions is zero.
+const DefaultMaxTransitions = 100
+
+// ErrTooManyTransitions is logged when an input makes a dialog follow more than MaxTransitions transitions,
+// e.g. because a step emits an event leading back to itself when entered.
+var ErrTooManyTransitions error = errors.New("too many dialog transitions")
+
+// Guard reports whether a transition may be followed, e.g. only if the user has a tag.
+// The data of the event is msg.EventData().
+type Guard func(bot *Bot, msg *Message) bool
+
+// transitionTarget is a destination of a transition, followed if its guard is nil or allows it.
+type transitionTarget struct {
+	dst   Step
+	guard Guard
+}
+
 type Step interface {
 	Name() string
 	Enter(*Bot, *Message) Event
@@ -17,10 +43,13 @@ type Step interface {
 	Leave(*Bot, *Message) Event
 }
 
+// defaultStepName is the name of steps that do not override BaseStep.Name.
+const defaultStepName = "unnamed step"
+
 // BaseStep is base struct for steps
 type BaseStep struct{}
 
-func (s BaseStep) Name() string                             { return "unnamed step" }
+func (s BaseStep) Name() string                             { return defaultStepName }
 func (s BaseStep) Enter(bot *Bot, msg *Message) (e Event)   { return e } // Do nothing
 func (s BaseStep) Process(bot *Bot, msg *Message) (e Event) { return e } // Do nothing
 func (s BaseStep) Leave(bot *Bot, msg *Message) (e Event)   { return e } // Do nothing
@@ -29,60 +58,238 @@ type Dialog struct {
 	beginStep Step
 	endStep   Step
 
-	currentStepMap map[string]Step // maps an user ID to his current step
-	p2pTransMap    map[Step]map[Event]Step
-	globalTransMap map[Event]Step
+	mutex          *sync.Mutex     // guards timers and entered, shared with reloaded dialogs
+	state          DialogState     // saves current step of users
+	persistent     bool            // whether state is set by SetState, so steps must have unique names
+	locks          *userLocks      // serializes events of the same user, shared with reloaded dialogs
+	stepsMutex     sync.RWMutex    // guards steps and keys, which Move may add to
+	steps          map[string]Step // maps a step key to the step
+	keys           map[Step]string // maps a step to the key it is saved under in state
+	duplicates     []string        // names used by several steps, reported by Validate
+	interrupts     []*Interrupt
+	timers         map[string]*time.Timer // maps an user ID to the timer ending his conversation
+	entered        map[string]time.Time   // maps an user ID to the time he entered his current step
+	scheduler      Scheduler              // keeps timeouts and reminders of steps
+	stepTimers     map[string]*stepTimer  // maps a step name to its timeout and reminders
+	p2pTransMap    map[Step]map[Event][]transitionTarget
+	globalTransMap map[Event][]transitionTarget
+
+	// Namespace, if set, isolates short-term memory of the dialog in the namespace of STMemory,
+	// so a restart of the dialog does not clear data of other components. Steps should use Memory.
+	// If empty, the whole STMemory of the user is cleared.
+	Namespace string
+
+	// Timeout, if not zero, ends the conversation of an user who has not sent anything for this duration:
+	// his short-term memory and current step are cleared, then ExpireHook is called.
+	Timeout time.Duration
+
+	// MaxReminders limits the number of reminders an user gets in a conversation,
+	// DefaultMaxReminders if zero, no limit if negative.
+	MaxReminders int
+
+	// MaxTransitions limits the number of transitions followed for an input, DefaultMaxTransitions if zero.
+	// When it is exceeded, ErrTooManyTransitions is logged and the user stays at the last step entered.
+	MaxTransitions int
 
 	// Hooks
 	PreHandleMessageHook   func(*Bot, *Message) bool
 	PostHandleMessageHook  func(*Bot, *Message)
 	PreHandlePostbackHook  func(*Bot, *Postback) bool
 	PostHandlePostbackHook func(*Bot, *Postback)
+	ExpireHook             func(*Bot, User) // called when a conversation ends by Timeout, e.g. to send a notice
+
+	// Step hooks, called before the entered step's Enter, see StepChange
+	EnterHook      func(*Bot, StepChange) // called when the user enters a step
+	LeaveHook      func(*Bot, StepChange) // called when the user leaves a step, even if he enters no other step
+	TransitionHook func(*Bot, StepChange) // called on every change, e.g. to record a Funnel
 }
 
 func NewDialog() *Dialog {
 	var d Dialog
-	d.currentStepMap = make(map[string]Step)
-	d.p2pTransMap = make(map[Step]map[Event]Step)
-	d.globalTransMap = make(map[Event]Step)
+	d.mutex = &sync.Mutex{}
+	d.locks = &userLocks{}
+	d.state = NewMemoryDialogState(memory.New("ephemeral"))
+	d.steps = make(map[string]Step)
+	d.keys = make(map[Step]string)
+	d.timers = make(map[string]*time.Timer)
+	d.entered = make(map[string]time.Time)
+	d.scheduler = NewMemoryScheduler(memory.New("ephemeral"))
+	d.stepTimers = make(map[string]*stepTimer)
+	d.p2pTransMap = make(map[Step]map[Event][]transitionTarget)
+	d.globalTransMap = make(map[Event][]transitionTarget)
 
 	return &d
 }
 
+// Memory returns short-term memory of the dialog, which is cleared when the dialog restarts.
+func (d *Dialog) Memory(bot *Bot) memory.Memory {
+	if d.Namespace == "" {
+		return bot.STMemory
+	}
+	return bot.STMemory.Namespace(d.Namespace)
+}
+
+// SetState replaces where current steps of users are saved, in process memory by default.
+// Steps are saved by name, so every step must override BaseStep.Name with a unique name:
+// SetState returns an error if a registered step does not, and steps registered afterwards panic.
+func (d *Dialog) SetState(state DialogState) error {
+	d.stepsMutex.Lock()
+	defer d.stepsMutex.Unlock()
+
+	for key, s := range d.steps {
+		if err := d.checkName(s.Name(), key); err != nil {
+			return err
+		}
+	}
+	d.state = state
+	d.persistent = true
+	return nil
+}
+
+// checkName returns an error if the step name saved under key can not be saved in a DialogState.
+func (d *Dialog) checkName(name string, key string) error {
+	if name == defaultStepName {
+		return fmt.Errorf("dialog step %q has no name of its own, it can not be saved in a DialogState", name)
+	}
+	if key != name {
+		return fmt.Errorf("dialog step name %q is used by several steps, it can not be saved in a DialogState", name)
+	}
+	return nil
+}
+
+// AddSteps registers steps by their names, so they can be found from the saved state.
+// Steps used in SetBeginStep, SetEndStep, AddTransition and Move are registered automatically.
+//
+// With the default in-process state, steps sharing a name, e.g. steps not overriding BaseStep.Name,
+// are told apart by identity. With a state set by SetState, AddSteps panics on them.
+func (d *Dialog) AddSteps(steps ...Step) {
+	d.stepsMutex.Lock()
+	defer d.stepsMutex.Unlock()
+
+	for _, s := range steps {
+		if _, ok := d.keys[s]; ok {
+			continue
+		}
+		name := s.Name()
+		key := name
+		if _, ok := d.steps[name]; ok {
+			log.Warnf("Dialog step name %q is used by several steps", name)
+			d.duplicates = append(d.duplicates, name)
+			for n := len(d.keys); ; n++ { // an in-process key for the step
+				key = fmt.Sprintf("%s#%d", name, n)
+				if _, ok := d.steps[key]; !ok {
+					break
+				}
+			}
+		}
+		if d.persistent {
+			if err := d.checkName(name, key); err != nil {
+				panic(err)
+			}
+		}
+		d.steps[key] = s
+		d.keys[s] = key
+	}
+}
+
+// key returns the key the step is saved under in state.
+func (d *Dialog) key(s Step) string {
+	d.stepsMutex.RLock()
+	defer d.stepsMutex.RUnlock()
+
+	if key, ok := d.keys[s]; ok {
+		return key
+	}
+	return s.Name()
+}
+
+// lookup returns the step saved under key in state.
+func (d *Dialog) lookup(key string) (Step, bool) {
+	d.stepsMutex.RLock()
+	defer d.stepsMutex.RUnlock()
+
+	s, ok := d.steps[key]
+	return s, ok
+}
+
 func (d *Dialog) SetBeginStep(s Step) {
+	d.AddSteps(s)
 	d.beginStep = s
 }
 
 func (d *Dialog) SetEndStep(s Step) {
+	d.AddSteps(s)
 	d.endStep = s
 }
 
 func (d *Dialog) AddTransition(event Event, steps ...Step) {
+	d.AddGuardedTransition(event, nil, steps...)
+}
+
+// AddGuardedTransition adds a transition followed only if guard allows it.
+// Guarded transitions of an event are checked in the order they are added,
+// before the transition added by AddTransition, which is followed if none allows it.
+// A nil guard always allows it.
+func (d *Dialog) AddGuardedTransition(event Event, guard Guard, steps ...Step) {
 	n := len(steps)
 	if n == 0 {
 		return
 	}
+	d.AddSteps(steps...)
 
+	target := transitionTarget{dst: steps[n-1], guard: guard}
 	if n == 1 { // global transition
-		d.globalTransMap[event] = steps[0]
+		d.globalTransMap[event] = addTarget(d.globalTransMap[event], target)
 		return
 	}
 
 	// point-to-point transition
-	srcs := steps[:n-1]
-	dst := steps[n-1]
-	for _, src := range srcs {
-		d.addP2PTransition(src, event, dst)
+	for _, src := range steps[:n-1] {
+		d.addP2PTransition(src, event, target)
 	}
 }
 
 // Add point-to-point transition
-func (d *Dialog) addP2PTransition(src Step, event Event, dst Step) {
+func (d *Dialog) addP2PTransition(src Step, event Event, target transitionTarget) {
 	_, exist := d.p2pTransMap[src]
 	if !exist {
-		d.p2pTransMap[src] = make(map[Event]Step)
+		d.p2pTransMap[src] = make(map[Event][]transitionTarget)
+	}
+	d.p2pTransMap[src][event] = addTarget(d.p2pTransMap[src][event], target)
+}
+
+// addTarget adds target to targets of an event, keeping the unguarded one last.
+// An unguarded target replaces the previous one.
+func addTarget(targets []transitionTarget, target transitionTarget) []transitionTarget {
+	n := len(targets)
+	if n > 0 && targets[n-1].guard == nil {
+		if target.guard == nil {
+			targets[n-1] = target
+			return targets
+		}
+		return append(targets[:n-1], target, targets[n-1])
+	}
+	return append(targets, target)
+}
+
+// route returns the destination of the event emitted by src, or nil if there is none.
+// Point-to-point transitions are checked before global ones.
+func (d *Dialog) route(bot *Bot, msg *Message, src Step, event Event) Step {
+	for _, targets := range [][]transitionTarget{d.p2pTransMap[src][event], d.globalTransMap[event]} {
+		for _, t := range targets {
+			if t.guard == nil || t.guard(bot, msg) {
+				return t.dst
+			}
+		}
 	}
-	d.p2pTransMap[src][event] = dst
+	return nil
+}
+
+func (d *Dialog) maxTransitions() int {
+	if d.MaxTransitions > 0 {
+		return d.MaxTransitions
+	}
+	return DefaultMaxTransitions
 }
 
 func (d *Dialog) HandleMessage(bot *Bot, msg *Message) {
@@ -94,20 +301,14 @@ func (d *Dialog) HandleMessage(bot *Bot, msg *Message) {
 	}
 
 	if d.beginStep == nil || d.endStep == nil {
-		log.Fatal("BeginStep and EndStep are not set.")
+		log.Fatal("BeginStep and EndStep are not set. Call Validate to check the dialog.")
 	}
 
-	var event Event
-	step := d.getStep(msg.Sender.ID)
-	if step == nil || step == d.endStep {
-		bot.STMemory.Delete(msg.Sender.ID)
-		d.setStep(msg.Sender.ID, d.beginStep)
-		step = d.getStep(msg.Sender.ID)
-		event = step.Enter(bot, msg)
-	} else {
-		event = step.Process(bot, msg)
-	}
-	d.transition(bot, msg, step, event)
+	unlock := d.locks.lock(msg.Sender.ID)
+	d.handle(bot, msg, true)
+	d.resetTimer(bot, msg.Sender)
+	d.schedule(bot, msg.Sender, time.Now())
+	unlock()
 
 	if d.PostHandleMessageHook != nil {
 		d.PostHandleMessageHook(bot, msg)
@@ -122,7 +323,8 @@ func (d *Dialog) HandlePostback(bot *Bot, pbk *Postback) {
 		}
 	}
 
-	msg := &Message{Sender: pbk.Sender, Text: pbk.Payload}
+	// Text is the payload too, for steps reading postbacks as text
+	msg := &Message{Sender: pbk.Sender, Platform: pbk.Platform, Text: pbk.Payload, Postback: pbk}
 	d.HandleMessage(bot, msg)
 
 	if d.PostHandlePostbackHook != nil {
@@ -130,58 +332,250 @@ func (d *Dialog) HandlePostback(bot *Bot, pbk *Postback) {
 	}
 }
 
-func (d *Dialog) transition(bot *Bot, msg *Message, src Step, event Event) {
-	if event == ResetEvent {
-		d.Reset(msg.Sender.ID)
-		return
+// HandleOptin handles the optin as a message whose Optin is set.
+func (d *Dialog) HandleOptin(bot *Bot, optin *Optin) {
+	d.HandleMessage(bot, &Message{Sender: optin.Sender, Platform: optin.Sender.Platform(), Optin: optin})
+}
+
+// HandleReferral handles the referral as a message whose Referral is set.
+func (d *Dialog) HandleReferral(bot *Bot, ref *Referral) {
+	d.HandleMessage(bot, &Message{Sender: ref.Sender, Platform: ref.Sender.Platform(), Referral: ref})
+}
+
+// handle moves the user through the dialog by the message, starting it if he is not in it.
+// It returns the result event and true when the user reaches the end step.
+// The dialog's memory is cleared on start if clear is true.
+func (d *Dialog) handle(bot *Bot, msg *Message, clear bool) (Event, bool) {
+	step := d.getStep(msg.Sender.ID)
+	if step == nil || step == d.endStep {
+		return d.start(bot, msg, clear)
+	}
+	for _, i := range d.interrupts {
+		if i.Match(msg) {
+			return d.interrupt(bot, msg, step, i)
+		}
+	}
+	return d.transition(bot, msg, step, step.Process(bot, msg))
+}
+
+func (d *Dialog) start(bot *Bot, msg *Message, clear bool) (Event, bool) {
+	var prev Step
+	if d.hooked() {
+		prev = d.getStep(msg.Sender.ID)
+	}
+	if clear {
+		d.Memory(bot).Delete(msg.Sender.ID)
 	}
+	d.state.Delete(msg.Sender.ID) // forget history of the previous conversation
+	d.notify(bot, msg.Sender, prev, NilEvent, d.beginStep)
+	d.setStep(msg.Sender.ID, d.beginStep)
+	return d.transition(bot, msg, d.beginStep, d.beginStep.Enter(bot, msg))
+}
+
+// transition follows transitions of the event emitted by src until a step emits no event with a transition,
+// at most MaxTransitions. It returns the result event and true when the user reaches the end step.
+func (d *Dialog) transition(bot *Bot, msg *Message, src Step, event Event) (Event, bool) {
+	for n := 0; ; n++ {
+		msg.eventData, msg.emitted = msg.emitted, nil
+		if event == ResetEvent {
+			d.notify(bot, msg.Sender, src, event, nil)
+			d.reset(msg.Sender.ID)
+			return NilEvent, false
+		}
 
-	var dst Step
-	var exist bool
-	// check point-to-point transition first
-	dst, exist = d.p2pTransMap[src][event]
-	if !exist { // if doesn't have point-to-point transition
-		// then check global transition
-		dst, exist = d.globalTransMap[event]
-		if !exist { // if doesn't have global transition too
-			return // then do nothing
+		dst := d.route(bot, msg, src, event)
+		if dst == nil {
+			return NilEvent, false
+		}
+		if n == d.maxTransitions() {
+			log.WithFields(log.Fields{
+				"user":  msg.Sender.ID,
+				"step":  src.Name(),
+				"event": event,
+			}).Error(ErrTooManyTransitions)
+			return NilEvent, false
 		}
+
+		src.Leave(bot, msg)
+		d.state.PushHistory(msg.Sender.ID, d.key(src))
+		d.notify(bot, msg.Sender, src, event, dst)
+		var end bool
+		if event, end = d.visit(bot, msg, dst); end {
+			return event, true
+		}
+		src = dst
+	}
+}
+
+// enter makes dst the current step of the user and follows transitions of the event it emits.
+func (d *Dialog) enter(bot *Bot, msg *Message, dst Step) (Event, bool) {
+	event, end := d.visit(bot, msg, dst)
+	if end {
+		return event, true
 	}
+	return d.transition(bot, msg, dst, event)
+}
 
-	// if have destination step
-	src.Leave(bot, msg)
+// visit makes dst the current step of the user and enters it.
+// It returns the event dst emits, and true if dst is the end step.
+func (d *Dialog) visit(bot *Bot, msg *Message, dst Step) (Event, bool) {
 	d.setStep(msg.Sender.ID, dst)
-	event = d.getStep(msg.Sender.ID).Enter(bot, msg)
-	d.transition(bot, msg, dst, event)
+	event := dst.Enter(bot, msg)
+	if dst == d.endStep {
+		if event == NilEvent {
+			event = DoneEvent
+		}
+		return event, true
+	}
+	return event, false
 }
 
 func (d *Dialog) setStep(user_id string, step Step) {
-	d.currentStepMap[user_id] = step
+	d.state.SetStep(user_id, d.key(step))
 }
 
+// getStep returns the current step of the user, or nil if he has none
+// or his saved step is no longer in the dialog.
 func (d *Dialog) getStep(user_id string) Step {
-	return d.currentStepMap[user_id]
+	name := d.state.Step(user_id)
+	if name == "" {
+		return nil
+	}
+	step, ok := d.lookup(name)
+	if !ok {
+		log.Warnf("Dialog step %q of user %s does not exist", name, user_id)
+	}
+	return step
 }
 
+// Reset forgets the current step of the user, so his next message enters the begin step.
+// Reset and Move wait for the user's message being handled, so they must not be called from steps and hooks
+// of the dialog: emit ResetEvent or use transitions there instead.
 func (d *Dialog) Reset(user_id string) {
-	delete(d.currentStepMap, user_id)
+	unlock := d.locks.lock(user_id)
+	defer unlock()
+
+	d.reset(user_id)
+}
+
+// reset forgets the current step of the user, whose lock is held.
+func (d *Dialog) reset(user_id string) {
+	d.state.Delete(user_id)
+	d.cancelJob(user_id)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.entered, user_id)
+
+	if t, ok := d.timers[user_id]; ok {
+		t.Stop()
+		delete(d.timers, user_id)
+	}
+}
+
+// resetTimer restarts counting the inactivity Timeout of the user.
+func (d *Dialog) resetTimer(bot *Bot, user User) {
+	if d.Timeout <= 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if t, ok := d.timers[user.ID]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.Timeout, func() {
+		d.mutex.Lock() // t is assigned with the mutex held
+		timer := t
+		d.mutex.Unlock()
+		d.expire(bot, user, timer)
+	})
+	d.timers[user.ID] = t
+}
+
+// expire ends the conversation of the user when his timer t fires.
+func (d *Dialog) expire(bot *Bot, user User, t *time.Timer) {
+	unlock := d.locks.lock(user.ID)
+	defer unlock()
+
+	d.mutex.Lock()
+	if d.timers[user.ID] != t { // the timer has been replaced or stopped meanwhile
+		d.mutex.Unlock()
+		return
+	}
+	delete(d.timers, user.ID)
+	d.mutex.Unlock()
+
+	step := d.getStep(user.ID)
+	if step != nil && step != d.endStep {
+		d.notify(bot, user, step, NilEvent, nil)
+	}
+	d.state.Delete(user.ID)
+	d.cancelJob(user.ID)
+	d.mutex.Lock()
+	delete(d.entered, user.ID)
+	d.mutex.Unlock()
+
+	d.Memory(bot).Delete(user.ID)
+	if d.ExpireHook != nil && step != nil && step != d.endStep {
+		d.ExpireHook(bot, user)
+	}
+}
+
+// Stack returns the current steps of the user from this dialog down to the innermost sub-dialog.
+func (d *Dialog) Stack(user_id string) []Step {
+	var stack []Step
+	for dialog := d; dialog != nil; {
+		step := dialog.getStep(user_id)
+		if step == nil {
+			break
+		}
+		stack = append(stack, step)
+		dialog = nil
+		if sub, ok := step.(*SubDialogStep); ok {
+			dialog = sub.dialog
+		}
+	}
+	return stack
 }
 
 // This function used for moving dialog to any step.
 // It should be used with caution for adhoc cases only, since it breaks already defined dialog flow.
-func (d *Dialog) Move(msg *Message, dst Step) {
+// dst is registered if it is not, so it does not need to be used in any transition.
+func (d *Dialog) Move(bot *Bot, msg *Message, dst Step) {
+	if dst != nil {
+		d.AddSteps(dst)
+	}
+
+	unlock := d.locks.lock(msg.Sender.ID)
+	defer unlock()
+
 	// Get out of current step nicely
 	currentStep := d.getStep(msg.Sender.ID)
 	if currentStep != nil {
 		currentStep.Leave(bot, msg)
+		d.state.PushHistory(msg.Sender.ID, d.key(currentStep))
 	}
 
 	if dst == nil || dst == d.endStep {
 		// Follow current logic for end step
-		bot.STMemory.Delete(msg.Sender.ID)
+		d.Memory(bot).Delete(msg.Sender.ID)
 		dst = d.beginStep
 	}
+	d.notify(bot, msg.Sender, currentStep, NilEvent, dst)
 	d.setStep(msg.Sender.ID, dst)
 	event := dst.Enter(bot, msg)
 	d.transition(bot, msg, dst, event)
+	d.schedule(bot, msg.Sender, messageTime(msg))
+}
+
+// messageTime returns when the message was sent, now if it has no timestamp.
+func messageTime(msg *Message) time.Time {
+	if msg.Timestamp == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, msg.Timestamp*int64(time.Millisecond))
 }
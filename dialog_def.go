@@ -0,0 +1,413 @@
+package fbbot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultStepEvent is emitted by a defined step when its definition has no event.
+const DefaultStepEvent Event = "next"
+
+// DialogDefinition describes a dialog in YAML or JSON, e.g.
+//
+//	begin: welcome
+//	end: bye
+//	namespace: signup
+//	steps:
+//	  - name: welcome
+//	    messages: ["Hi!", "What is your email?"]
+//	    expect: email
+//	    key: email
+//	  - name: plan
+//	    messages: ["Which plan do you want?"]
+//	    quick_replies:
+//	      - {title: Free, payload: free, event: free}
+//	      - {title: Pro, payload: pro}
+//	    key: plan
+//	  - name: bye
+//	    messages: ["Thanks!"]
+//	transitions:
+//	  - {from: [welcome], event: next, to: plan}
+//	  - {from: [plan], event: free, to: bye}
+//	  - {from: [plan], event: next, to: payment} # payment is a custom step
+//	  - {event: cancel, to: bye}                 # global transition
+type DialogDefinition struct {
+	Begin       string                 `yaml:"begin" json:"begin"`
+	End         string                 `yaml:"end" json:"end"`
+	Namespace   string                 `yaml:"namespace" json:"namespace"`
+	Timeout     string                 `yaml:"timeout" json:"timeout"` // e.g. "30m"
+	Steps       []StepDefinition       `yaml:"steps" json:"steps"`
+	Transitions []TransitionDefinition `yaml:"transitions" json:"transitions"`
+}
+
+// StepDefinition describes a step sending messages when entered, then waiting for an input if it expects one.
+type StepDefinition struct {
+	Name         string                 `yaml:"name" json:"name"`
+	Messages     []string               `yaml:"messages" json:"messages"`           // texts sent when the step is entered
+	QuickReplies []QuickReplyDefinition `yaml:"quick_replies" json:"quick_replies"` // sent with the last message, answer must be one of them
+	Expect       string                 `yaml:"expect" json:"expect"`               // text, email, phone, number, date, location or image; empty for none
+	Key          string                 `yaml:"key" json:"key"`                     // memory key the answer is saved under, if set
+	Event        string                 `yaml:"event" json:"event"`                 // emitted after the answer, or when entered if no input is expected
+	ErrorMessage string                 `yaml:"error_message" json:"error_message"` // sent on invalid answers
+}
+
+// QuickReplyDefinition is a choice of a step, which may emit its own event.
+type QuickReplyDefinition struct {
+	Title   string `yaml:"title" json:"title"`
+	Payload string `yaml:"payload" json:"payload"` // the title if empty
+	Event   string `yaml:"event" json:"event"`     // the event of the step if empty
+}
+
+// TransitionDefinition is a transition from steps, or from any step if From is empty.
+type TransitionDefinition struct {
+	From  []string `yaml:"from" json:"from"`
+	Event string   `yaml:"event" json:"event"`
+	To    string   `yaml:"to" json:"to"`
+}
+
+// definedValidators maps values of StepDefinition.Expect to validators.
+var definedValidators = map[string]Validator{
+	"text":     ValidateText,
+	"email":    ValidateEmail,
+	"phone":    ValidatePhone,
+	"number":   ValidateNumber,
+	"date":     ValidateDate(),
+	"location": ValidateLocation,
+	"image":    ValidateImage,
+}
+
+// ParseDialog compiles a dialog from its definition in YAML or JSON.
+// Custom steps written in Go can be referred to by their names in the definition.
+// The dialog is validated before it is returned.
+func ParseDialog(data []byte, custom ...Step) (*Dialog, error) {
+	var def DialogDefinition
+	if err := yaml.UnmarshalStrict(data, &def); err != nil {
+		return nil, err
+	}
+	return def.Compile(custom...)
+}
+
+// Compile builds the dialog described by the definition.
+func (def *DialogDefinition) Compile(custom ...Step) (*Dialog, error) {
+	d := NewDialog()
+	d.Namespace = def.Namespace
+	if def.Timeout != "" {
+		timeout, err := time.ParseDuration(def.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %v", err)
+		}
+		d.Timeout = timeout
+	}
+
+	steps := make(map[string]Step)
+	for _, s := range custom {
+		steps[s.Name()] = s
+	}
+	for _, sd := range def.Steps {
+		if _, ok := steps[sd.Name]; ok {
+			return nil, fmt.Errorf("step %q is defined several times", sd.Name)
+		}
+		s, err := newDefinedStep(sd, def.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		steps[sd.Name] = s
+	}
+	step := func(name string) (Step, error) {
+		s, ok := steps[name]
+		if !ok {
+			return nil, fmt.Errorf("step %q is not defined", name)
+		}
+		return s, nil
+	}
+
+	begin, err := step(def.Begin)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %v", err)
+	}
+	end, err := step(def.End)
+	if err != nil {
+		return nil, fmt.Errorf("end: %v", err)
+	}
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+
+	for _, td := range def.Transitions {
+		var path []Step
+		for _, name := range append(td.From, td.To) {
+			s, err := step(name)
+			if err != nil {
+				return nil, fmt.Errorf("transition %q: %v", td.Event, err)
+			}
+			path = append(path, s)
+		}
+		d.AddTransition(Event(td.Event), path...)
+	}
+
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// definedStep is a step compiled from a StepDefinition.
+type definedStep struct {
+	BaseStep
+	def       StepDefinition
+	namespace string
+	validate  Validator
+}
+
+func newDefinedStep(def StepDefinition, namespace string) (*definedStep, error) {
+	if def.Name == "" {
+		return nil, fmt.Errorf("a step has no name")
+	}
+	s := &definedStep{def: def, namespace: namespace}
+	if def.Event == "" {
+		s.def.Event = string(DefaultStepEvent)
+	}
+	if len(def.QuickReplies) > 0 {
+		items := make([]QuickRepliesItem, len(def.QuickReplies))
+		for i, qr := range def.QuickReplies {
+			items[i] = s.item(qr)
+		}
+		s.validate = ValidateChoice(items...)
+	}
+	if def.Expect != "" {
+		v, ok := definedValidators[def.Expect]
+		if !ok {
+			return nil, fmt.Errorf("step %q expects unknown input %q", def.Name, def.Expect)
+		}
+		s.validate = v
+	}
+	return s, nil
+}
+
+func (s *definedStep) Name() string {
+	return s.def.Name
+}
+
+func (s *definedStep) item(qr QuickReplyDefinition) QuickRepliesItem {
+	payload := qr.Payload
+	if payload == "" {
+		payload = qr.Title
+	}
+	return NewQuickRepliesText(qr.Title, payload)
+}
+
+func (s *definedStep) Enter(bot *Bot, msg *Message) Event {
+	n := len(s.def.Messages)
+	for i, text := range s.def.Messages {
+		if i == n-1 && len(s.def.QuickReplies) > 0 {
+			break
+		}
+		bot.SendText(msg.Sender, text)
+	}
+	if len(s.def.QuickReplies) > 0 {
+		s.ask(bot, msg.Sender)
+	}
+	if s.validate == nil {
+		return Event(s.def.Event)
+	}
+	return NilEvent
+}
+
+// ask sends the last message with the quick replies.
+func (s *definedStep) ask(bot *Bot, u User) {
+	var text string
+	if n := len(s.def.Messages); n > 0 {
+		text = s.def.Messages[n-1]
+	}
+	items := make([]QuickRepliesItem, len(s.def.QuickReplies))
+	for i, qr := range s.def.QuickReplies {
+		items[i] = s.item(qr)
+	}
+	bot.Send(u, &QuickRepliesMessage{Text: text, Items: items})
+}
+
+func (s *definedStep) Process(bot *Bot, msg *Message) Event {
+	if s.validate == nil {
+		return Event(s.def.Event)
+	}
+	value, err := s.validate(msg)
+	if err != nil {
+		text := s.def.ErrorMessage
+		if text == "" {
+			text = err.Error()
+		}
+		bot.SendText(msg.Sender, text)
+		if len(s.def.QuickReplies) > 0 {
+			s.ask(bot, msg.Sender)
+		}
+		return NilEvent
+	}
+
+	if s.def.Key != "" {
+		m := bot.STMemory
+		if s.namespace != "" {
+			m = m.Namespace(s.namespace)
+		}
+		m.For(msg.Sender.ID).Set(s.def.Key, value)
+	}
+	for _, qr := range s.def.QuickReplies {
+		if qr.Event != "" && s.item(qr).Payload == value {
+			return Event(qr.Event)
+		}
+	}
+	return Event(s.def.Event)
+}
+
+// DialogFile is a dialog defined in a YAML or JSON file,
+// compiled again whenever the file is modified so flows can change without a release.
+// Users keep their current steps across reloads if the steps still exist,
+// and configuration set in Go on the dialog, e.g. hooks and interrupts, is kept.
+// If the modified file is invalid, the error is logged and the previous dialog is kept.
+type DialogFile struct {
+	Path string
+
+	// CheckInterval is how often Dialog checks whether the file is modified, DefaultDialogCheckInterval if zero.
+	CheckInterval time.Duration
+
+	custom    []Step
+	mutex     sync.Mutex
+	checked   time.Time // time the file was last checked
+	modTime   time.Time
+	dialog    *Dialog
+	timeout   time.Duration // Timeout of the dialog defined in the file
+	namespace string        // Namespace of the dialog defined in the file
+}
+
+// DefaultDialogCheckInterval is how often a DialogFile checks whether its file is modified by default.
+const DefaultDialogCheckInterval = time.Second
+
+// NewDialogFile compiles the dialog defined in the file, which may refer to the custom steps by name.
+func NewDialogFile(path string, custom ...Step) (*DialogFile, error) {
+	f := &DialogFile{Path: path, custom: custom}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload compiles the dialog again if the file has been modified since it was last compiled.
+func (f *DialogFile) Reload() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.checked = time.Now()
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if f.dialog != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	d, err := ParseDialog(data, f.custom...)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+	timeout, namespace := d.Timeout, d.Namespace
+	if f.dialog != nil {
+		if err := d.inherit(f.dialog); err != nil {
+			return fmt.Errorf("%s: %v", f.Path, err)
+		}
+		// values set in Go override the file
+		if f.dialog.Timeout != f.timeout {
+			d.Timeout = f.dialog.Timeout
+		}
+		if f.dialog.Namespace != f.namespace {
+			d.Namespace = f.dialog.Namespace
+		}
+	}
+	f.dialog = d
+	f.modTime = info.ModTime()
+	f.timeout, f.namespace = timeout, namespace
+	return nil
+}
+
+// inherit makes the dialog take over users of the old dialog and its configuration set in Go:
+// state, scheduler, step timers, interrupts, MaxReminders, MaxTransitions and hooks.
+// Timeout and Namespace set in Go are kept by Reload, which knows the values defined in the file.
+// Both dialogs share locks of users and conversation timers, so events handled during a reload stay serialized.
+func (d *Dialog) inherit(old *Dialog) error {
+	if !old.persistent {
+		d.state = old.state
+	} else if err := d.SetState(old.state); err != nil {
+		return err
+	}
+	d.mutex = old.mutex
+	d.locks = old.locks
+	d.timers = old.timers
+	d.entered = old.entered
+	d.scheduler = old.scheduler
+	d.stepTimers = old.stepTimers
+	for _, i := range old.interrupts {
+		i := *i
+		if i.Abort != nil {
+			if s, ok := d.lookup(old.key(i.Abort)); ok {
+				i.Abort = s
+			}
+		}
+		d.AddInterrupt(&i)
+	}
+
+	d.MaxReminders = old.MaxReminders
+	d.MaxTransitions = old.MaxTransitions
+	d.PreHandleMessageHook = old.PreHandleMessageHook
+	d.PostHandleMessageHook = old.PostHandleMessageHook
+	d.PreHandlePostbackHook = old.PreHandlePostbackHook
+	d.PostHandlePostbackHook = old.PostHandlePostbackHook
+	d.ExpireHook = old.ExpireHook
+	d.EnterHook = old.EnterHook
+	d.LeaveHook = old.LeaveHook
+	d.TransitionHook = old.TransitionHook
+	return nil
+}
+
+// Dialog returns the latest dialog compiled from the file,
+// compiling it again if the file has been modified and it has not been checked for CheckInterval.
+func (f *DialogFile) Dialog() *Dialog {
+	f.mutex.Lock()
+	interval := f.CheckInterval
+	if interval == 0 {
+		interval = DefaultDialogCheckInterval
+	}
+	due := time.Since(f.checked) >= interval
+	f.mutex.Unlock()
+
+	if due {
+		if err := f.Reload(); err != nil {
+			log.Errorf("Failed to reload dialog: %v", err)
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.dialog
+}
+
+func (f *DialogFile) HandleMessage(bot *Bot, msg *Message) {
+	f.Dialog().HandleMessage(bot, msg)
+}
+
+func (f *DialogFile) HandlePostback(bot *Bot, pbk *Postback) {
+	f.Dialog().HandlePostback(bot, pbk)
+}
+
+func (f *DialogFile) HandleOptin(bot *Bot, optin *Optin) {
+	f.Dialog().HandleOptin(bot, optin)
+}
+
+func (f *DialogFile) HandleReferral(bot *Bot, ref *Referral) {
+	f.Dialog().HandleReferral(bot, ref)
+}
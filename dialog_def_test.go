@@ -0,0 +1,151 @@
+package fbbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDialogDefinition = `
+begin: welcome
+end: bye
+steps:
+  - name: welcome
+  - name: bye
+transitions:
+  - {from: [welcome], event: next, to: bye}
+`
+
+func TestDialogFileReloadKeepsConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dialog.yaml")
+	if err := ioutil.WriteFile(path, []byte(testDialogDefinition), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewDialogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := f.Dialog()
+	old.MaxTransitions = 5
+	old.MaxReminders = 2
+	old.EnterHook = func(*Bot, StepChange) {}
+	bye, _ := old.lookup("bye")
+	old.AddInterrupt(&Interrupt{Match: MatchText("cancel"), Abort: bye})
+	old.SetStepTimeout(bye, time.Minute)
+	old.Timeout = 5 * time.Minute
+	old.Namespace = "signup"
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if f.Dialog() != old {
+		t.Fatal("Dialog() checked the file again before CheckInterval")
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	d := f.Dialog()
+	if d == old {
+		t.Fatal("Reload() did not compile the modified file again")
+	}
+	if d.Timeout != 5*time.Minute || d.Namespace != "signup" {
+		t.Errorf("reloaded dialog has Timeout %v and Namespace %q, want the values set in Go", d.Timeout, d.Namespace)
+	}
+	if d.MaxTransitions != 5 || d.MaxReminders != 2 || d.EnterHook == nil {
+		t.Errorf("reloaded dialog lost MaxTransitions, MaxReminders or hooks")
+	}
+	if d.locks != old.locks || d.mutex != old.mutex || d.state != old.state || d.scheduler != old.scheduler {
+		t.Errorf("reloaded dialog does not share locks, state and scheduler")
+	}
+	if d.stepTimers["bye"] == nil || d.stepTimers["bye"].timeout != time.Minute {
+		t.Errorf("reloaded dialog lost step timers")
+	}
+	newBye, _ := d.lookup("bye")
+	if len(d.interrupts) != 1 || d.interrupts[0].Abort != newBye || newBye == bye {
+		t.Errorf("interrupt of the reloaded dialog does not abort to its own step")
+	}
+	if old.interrupts[0].Abort != bye {
+		t.Errorf("interrupt of the previous dialog was changed")
+	}
+}
+
+func TestDialogFileReloadAppliesFileValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dialog.yaml")
+	if err := ioutil.WriteFile(path, []byte("timeout: 30m\n"+testDialogDefinition), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewDialogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.CheckInterval = time.Nanosecond
+
+	if err := ioutil.WriteFile(path, []byte("timeout: 45m\nnamespace: signup\n"+testDialogDefinition), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if d := f.Dialog(); d.Timeout != 45*time.Minute || d.Namespace != "signup" {
+		t.Errorf("reloaded dialog has Timeout %v and Namespace %q, want the values of the file", d.Timeout, d.Namespace)
+	}
+}
+
+func TestDialogFileHandlesOptinsAndReferrals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dialog.yaml")
+	definition := `
+begin: welcome
+end: bye
+steps:
+  - name: welcome
+    expect: text
+  - name: bye
+transitions:
+  - {from: [welcome], event: next, to: bye}
+`
+	if err := ioutil.WriteFile(path, []byte(definition), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewDialogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ OptinHandler = f
+	var _ ReferralHandler = f
+
+	bot := newTestBot()
+	var kinds []InputKind
+	f.Dialog().PreHandleMessageHook = func(bot *Bot, msg *Message) bool {
+		kinds = append(kinds, msg.Kind())
+		return false
+	}
+	f.HandleOptin(bot, &Optin{Sender: User{ID: "u1"}, Ref: "plugin"})
+	f.HandleReferral(bot, &Referral{Sender: User{ID: "u1"}, Ref: "ad"})
+	if len(kinds) != 2 || kinds[0] != InputOptin || kinds[1] != InputReferral {
+		t.Errorf("dialog handled %v, want an optin and a referral", kinds)
+	}
+	if got, _ := f.Dialog().lookup("welcome"); f.Dialog().getStep("u1") != got {
+		t.Errorf("step after the optin = %v, want welcome", f.Dialog().getStep("u1"))
+	}
+}
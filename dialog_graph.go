@@ -0,0 +1,252 @@
+package fbbot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DialogError lists structural problems of a dialog found by Validate.
+type DialogError struct {
+	Problems []string
+}
+
+func (e *DialogError) Error() string {
+	return "invalid dialog: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the structure of the dialog: begin and end steps are set, step names are unique,
+// every step is reachable from the begin step and the end step is reachable from every step.
+// It returns a *DialogError listing the problems, or nil. Call it after defining the dialog.
+func (d *Dialog) Validate() error {
+	d.stepsMutex.RLock()
+	defer d.stepsMutex.RUnlock()
+
+	var problems []string
+	if d.beginStep == nil {
+		problems = append(problems, "begin step is not set")
+	}
+	if d.endStep == nil {
+		problems = append(problems, "end step is not set")
+	}
+	seen := make(map[string]bool)
+	for _, name := range d.duplicates {
+		if !seen[name] {
+			seen[name] = true
+			problems = append(problems, fmt.Sprintf("step name %q is used by several steps", name))
+		}
+	}
+
+	if d.beginStep != nil {
+		reachable := d.reachable()
+		for _, name := range d.stepNames() {
+			if !reachable[d.steps[name]] {
+				problems = append(problems, fmt.Sprintf("step %q is unreachable from the begin step", name))
+			}
+		}
+	}
+	if d.endStep != nil {
+		finishing := d.finishing()
+		for _, name := range d.stepNames() {
+			if !finishing[d.steps[name]] {
+				problems = append(problems, fmt.Sprintf("step %q has no way to the end step", name))
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &DialogError{Problems: problems}
+}
+
+// reachable returns the steps reachable from the begin step.
+// Destinations of global transitions and interrupts can be reached from any step.
+func (d *Dialog) reachable() map[Step]bool {
+	reached := make(map[Step]bool)
+	queue := []Step{d.beginStep}
+	for _, targets := range d.globalTransMap {
+		for _, t := range targets {
+			queue = append(queue, t.dst)
+		}
+	}
+	for _, i := range d.interrupts {
+		if i.Abort != nil {
+			queue = append(queue, i.Abort)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if reached[s] {
+			continue
+		}
+		reached[s] = true
+		for _, targets := range d.p2pTransMap[s] {
+			for _, t := range targets {
+				queue = append(queue, t.dst)
+			}
+		}
+	}
+	return reached
+}
+
+// finishing returns the steps from which the end step can be reached.
+func (d *Dialog) finishing() map[Step]bool {
+	finished := map[Step]bool{d.endStep: true}
+	global := false // whether a global transition leads to the end step
+	for changed := true; changed; {
+		changed = false
+		if !global {
+			for _, targets := range d.globalTransMap {
+				for _, t := range targets {
+					if finished[t.dst] {
+						global = true
+						changed = true
+					}
+				}
+			}
+		}
+		for _, s := range d.steps {
+			if finished[s] {
+				continue
+			}
+			ok := global
+			for _, targets := range d.p2pTransMap[s] {
+				for _, t := range targets {
+					ok = ok || finished[t.dst]
+				}
+			}
+			if ok {
+				finished[s] = true
+				changed = true
+			}
+		}
+	}
+	return finished
+}
+
+// stepNames returns the keys of the registered steps, sorted.
+// Keys are step names, suffixed by "#n" for steps sharing a name.
+func (d *Dialog) stepNames() []string {
+	names := make([]string, 0, len(d.steps))
+	for name := range d.steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dialogEdge is a transition, from nil for a global one.
+type dialogEdge struct {
+	src     Step
+	event   Event
+	dst     Step
+	guarded bool
+}
+
+// label returns the label of the edge, the event followed by "?" if the transition is guarded.
+func (e dialogEdge) label() string {
+	if e.guarded {
+		return string(e.event) + "?"
+	}
+	return string(e.event)
+}
+
+// edges returns the transitions of the dialog in a stable order, global ones last.
+func (d *Dialog) edges() []dialogEdge {
+	var edges []dialogEdge
+	for _, name := range d.stepNames() {
+		src := d.steps[name]
+		events := make([]string, 0, len(d.p2pTransMap[src]))
+		for e := range d.p2pTransMap[src] {
+			events = append(events, string(e))
+		}
+		sort.Strings(events)
+		for _, e := range events {
+			for _, t := range d.p2pTransMap[src][Event(e)] {
+				edges = append(edges, dialogEdge{src, Event(e), t.dst, t.guard != nil})
+			}
+		}
+	}
+	events := make([]string, 0, len(d.globalTransMap))
+	for e := range d.globalTransMap {
+		events = append(events, string(e))
+	}
+	sort.Strings(events)
+	for _, e := range events {
+		for _, t := range d.globalTransMap[Event(e)] {
+			edges = append(edges, dialogEdge{nil, Event(e), t.dst, t.guard != nil})
+		}
+	}
+	return edges
+}
+
+// Mermaid renders the steps and transitions of the dialog as a Mermaid flowchart.
+// Global transitions start from the "any step" node and are dashed, guarded ones are labeled "event?".
+func (d *Dialog) Mermaid() string {
+	d.stepsMutex.RLock()
+	defer d.stepsMutex.RUnlock()
+
+	ids := make(map[Step]string)
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for i, name := range d.stepNames() {
+		s := d.steps[name]
+		ids[s] = "s" + strconv.Itoa(i)
+		label := strings.Replace(name, `"`, "#quot;", -1)
+		switch s {
+		case d.beginStep:
+			fmt.Fprintf(&b, "    %s([\"%s\"])\n", ids[s], label)
+		case d.endStep:
+			fmt.Fprintf(&b, "    %s(((\"%s\")))\n", ids[s], label)
+		default:
+			fmt.Fprintf(&b, "    %s[\"%s\"]\n", ids[s], label)
+		}
+	}
+	if len(d.globalTransMap) > 0 {
+		b.WriteString("    any{{\"any step\"}}\n")
+	}
+	for _, e := range d.edges() {
+		label := strings.Replace(e.label(), `"`, "#quot;", -1)
+		if e.src == nil {
+			fmt.Fprintf(&b, "    any -.->|\"%s\"| %s\n", label, ids[e.dst])
+		} else {
+			fmt.Fprintf(&b, "    %s -->|\"%s\"| %s\n", ids[e.src], label, ids[e.dst])
+		}
+	}
+	return b.String()
+}
+
+// DOT renders the steps and transitions of the dialog in the Graphviz DOT language.
+// Global transitions start from the "*" node and are dashed, guarded ones are labeled "event?".
+func (d *Dialog) DOT() string {
+	d.stepsMutex.RLock()
+	defer d.stepsMutex.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("digraph dialog {\n    rankdir=LR;\n")
+	for _, name := range d.stepNames() {
+		switch d.steps[name] {
+		case d.beginStep:
+			fmt.Fprintf(&b, "    %s [shape=box, style=bold];\n", strconv.Quote(name))
+		case d.endStep:
+			fmt.Fprintf(&b, "    %s [shape=doublecircle];\n", strconv.Quote(name))
+		default:
+			fmt.Fprintf(&b, "    %s [shape=box];\n", strconv.Quote(name))
+		}
+	}
+	if len(d.globalTransMap) > 0 {
+		b.WriteString("    \"*\" [shape=point];\n")
+	}
+	for _, e := range d.edges() {
+		if e.src == nil {
+			fmt.Fprintf(&b, "    \"*\" -> %s [label=%s, style=dashed];\n", strconv.Quote(d.keys[e.dst]), strconv.Quote(e.label()))
+		} else {
+			fmt.Fprintf(&b, "    %s -> %s [label=%s];\n", strconv.Quote(d.keys[e.src]), strconv.Quote(d.keys[e.dst]), strconv.Quote(e.label()))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package fbbot
+
+import (
+	"strings"
+	"testing"
+)
+
+// problems returns the problems reported by Validate.
+func problems(t *testing.T, d *Dialog) []string {
+	t.Helper()
+	err := d.Validate()
+	if err == nil {
+		return nil
+	}
+	derr, ok := err.(*DialogError)
+	if !ok {
+		t.Fatalf("Validate() = %T, want *DialogError", err)
+	}
+	return derr.Problems
+}
+
+func TestDialogValidate(t *testing.T) {
+	welcome, ask, bye := &namedStep{name: "welcome"}, &namedStep{name: "ask"}, &namedStep{name: "bye"}
+	d := NewDialog()
+	d.SetBeginStep(welcome)
+	d.SetEndStep(bye)
+	d.AddTransition("next", welcome, ask)
+	d.AddTransition("done", ask, bye)
+	if got := problems(t, d); got != nil {
+		t.Errorf("Validate() of a valid dialog = %q, want nil", got)
+	}
+
+	if got := problems(t, NewDialog()); len(got) != 2 {
+		t.Errorf("Validate() of an empty dialog = %q, want begin and end steps not set", got)
+	}
+
+	tests := []struct {
+		name  string
+		build func(d *Dialog)
+		want  []string
+	}{
+		{"unreachable", func(d *Dialog) {
+			d.AddTransition("done", &namedStep{name: "orphan"}, bye)
+		}, []string{`step "orphan" is unreachable from the begin step`}},
+		{"no way to the end", func(d *Dialog) {
+			d.AddTransition("stuck", ask, &namedStep{name: "trap"})
+		}, []string{`step "trap" has no way to the end step`}},
+		{"duplicate names", func(d *Dialog) {
+			d.AddTransition("again", ask, &namedStep{name: "ask"})
+		}, []string{`step name "ask" is used by several steps`, `has no way to the end step`}},
+		{"global transition reaches", func(d *Dialog) {
+			help := &namedStep{name: "help"}
+			d.AddTransition("help", help)
+			d.AddTransition("back", help, welcome)
+		}, nil},
+		{"interrupt reaches", func(d *Dialog) {
+			cancel := &namedStep{name: "cancel"}
+			d.AddInterrupt(&Interrupt{Match: MatchText("cancel"), Abort: cancel})
+			d.AddTransition("done", cancel, bye)
+		}, nil},
+		{"global transition to the end finishes", func(d *Dialog) {
+			d.AddTransition("next", ask, &namedStep{name: "loop"})
+			d.AddTransition("quit", bye)
+		}, nil},
+	}
+	for _, tt := range tests {
+		d := NewDialog()
+		d.SetBeginStep(welcome)
+		d.SetEndStep(bye)
+		d.AddTransition("next", welcome, ask)
+		d.AddTransition("done", ask, bye)
+		tt.build(d)
+
+		got := problems(t, d)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: Validate() = %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !strings.Contains(got[i], tt.want[i]) {
+				t.Errorf("%s: problem %q, want %q", tt.name, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+// graphDialog returns a dialog with guarded, global and quoted transitions.
+func graphDialog() *Dialog {
+	welcome, ask, bye := &namedStep{name: "welcome"}, &namedStep{name: `ask "name"`}, &namedStep{name: "bye"}
+	help := &namedStep{name: "help"}
+	d := NewDialog()
+	d.SetBeginStep(welcome)
+	d.SetEndStep(bye)
+	d.AddTransition("next", welcome, ask)
+	d.AddGuardedTransition("next", func(*Bot, *Message) bool { return false }, welcome, bye)
+	d.AddTransition(`say "hi"`, ask, bye)
+	d.AddTransition("help", help)
+	d.AddTransition("back", help, welcome)
+	return d
+}
+
+func TestDialogMermaid(t *testing.T) {
+	want := `flowchart LR
+    s0["ask #quot;name#quot;"]
+    s1((("bye")))
+    s2["help"]
+    s3(["welcome"])
+    any{{"any step"}}
+    s0 -->|"say #quot;hi#quot;"| s1
+    s2 -->|"back"| s3
+    s3 -->|"next?"| s1
+    s3 -->|"next"| s0
+    any -.->|"help"| s2
+`
+	if got := graphDialog().Mermaid(); got != want {
+		t.Errorf("Mermaid() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDialogDOT(t *testing.T) {
+	want := `digraph dialog {
+    rankdir=LR;
+    "ask \"name\"" [shape=box];
+    "bye" [shape=doublecircle];
+    "help" [shape=box];
+    "welcome" [shape=box, style=bold];
+    "*" [shape=point];
+    "ask \"name\"" -> "bye" [label="say \"hi\""];
+    "help" -> "welcome" [label="back"];
+    "welcome" -> "bye" [label="next?"];
+    "welcome" -> "ask \"name\"" [label="next"];
+    "*" -> "help" [label="help", style=dashed];
+}
+`
+	if got := graphDialog().DOT(); got != want {
+		t.Errorf("DOT() =\n%s\nwant\n%s", got, want)
+	}
+}
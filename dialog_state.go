@@ -0,0 +1,135 @@
+package fbbot
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/michlabs/fbbot/memory"
+)
+
+// Keys the current step and the step history are saved under
+const (
+	dialogStepKey    = "step"
+	dialogHistoryKey = "history"
+)
+
+// MaxDialogHistory is how many previous steps of an user are kept for going back.
+const MaxDialogHistory = 20
+
+// DialogState saves the current step of every user in a dialog,
+// so conversations survive restarts and are shared by replicas.
+// A dialog serializes events of the same user within its process only,
+// so replicas should receive events of an user one at a time, e.g. by routing users to replicas.
+type DialogState interface {
+	Step(userID string) string              // name of the user's current step, empty if he has none
+	SetStep(userID string, name string)     // save name of the user's current step
+	PushHistory(userID string, name string) // save name of a step the user has left
+	PopHistory(userID string) string        // remove and return name of the step the user has left last, empty if none
+	Delete(userID string)                   // forget the user's current step and history
+}
+
+// memoryDialogState saves current steps in a memory
+type memoryDialogState struct {
+	memory memory.Memory
+}
+
+// NewMemoryDialogState returns a DialogState saving current steps in the memory,
+// e.g. a namespace of Bot.LTMemory backed by Redis.
+func NewMemoryDialogState(m memory.Memory) DialogState {
+	return &memoryDialogState{memory: m}
+}
+
+func (s *memoryDialogState) Step(userID string) string {
+	return s.memory.For(userID).Get(dialogStepKey)
+}
+
+func (s *memoryDialogState) SetStep(userID string, name string) {
+	s.memory.For(userID).Set(dialogStepKey, name)
+}
+
+func (s *memoryDialogState) PushHistory(userID string, name string) {
+	s.updateHistory(userID, func(history []string) []string {
+		history = append(history, name)
+		if len(history) > MaxDialogHistory {
+			history = history[len(history)-MaxDialogHistory:]
+		}
+		return history
+	})
+}
+
+func (s *memoryDialogState) PopHistory(userID string) string {
+	var name string
+	s.updateHistory(userID, func(history []string) []string {
+		name = ""
+		if len(history) == 0 {
+			return history
+		}
+		name = history[len(history)-1]
+		return history[:len(history)-1]
+	})
+	return name
+}
+
+// updateHistory replaces the history of the user by the result of f by compare-and-swap,
+// so replicas sharing the memory do not overwrite each other's changes.
+func (s *memoryDialogState) updateHistory(userID string, f func(history []string) []string) {
+	store := s.memory.For(userID)
+	for {
+		old := store.Get(dialogHistoryKey)
+		var history []string
+		if old != "" {
+			json.Unmarshal([]byte(old), &history)
+		}
+		data, err := json.Marshal(f(history))
+		if err != nil {
+			return
+		}
+		if store.CompareAndSwap(dialogHistoryKey, old, string(data)) {
+			return
+		}
+	}
+}
+
+func (s *memoryDialogState) Delete(userID string) {
+	store := s.memory.For(userID)
+	store.Delete(dialogStepKey)
+	store.Delete(dialogHistoryKey)
+}
+
+// userLocks serializes handling of events of the same user in the process
+type userLocks struct {
+	mutex sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int // number of goroutines holding or waiting for the lock
+}
+
+// lock locks the user and returns the function unlocking him.
+func (l *userLocks) lock(userID string) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*userLock)
+	}
+	ul, ok := l.locks[userID]
+	if !ok {
+		ul = &userLock{}
+		l.locks[userID] = ul
+	}
+	ul.refs++
+	l.mutex.Unlock()
+
+	ul.Lock()
+	return func() {
+		ul.Unlock()
+
+		l.mutex.Lock()
+		ul.refs--
+		if ul.refs == 0 {
+			delete(l.locks, userID)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,184 @@
+package fbbot
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michlabs/fbbot/memory"
+)
+
+// countStep is an unnamed step counting the messages it processes and emitting its event.
+type countStep struct {
+	BaseStep
+	event     Event
+	processed int
+}
+
+func (s *countStep) Process(bot *Bot, msg *Message) Event {
+	s.processed++
+	return s.event
+}
+
+// namedStep is a step with a name of its own.
+type namedStep struct {
+	BaseStep
+	name string
+}
+
+func (s *namedStep) Name() string { return s.name }
+
+func testMessage(userID string) *Message {
+	return &Message{Sender: User{ID: userID}}
+}
+
+func TestDialogStepsWithoutNames(t *testing.T) {
+	bot := newTestBot()
+	first, second, end := &countStep{event: "next"}, &countStep{}, &countStep{}
+	d := NewDialog()
+	d.SetBeginStep(first)
+	d.SetEndStep(end)
+	d.AddTransition("next", first, second)
+	d.AddTransition("done", second, end)
+
+	d.HandleMessage(bot, testMessage("u1")) // enters the begin step
+	d.HandleMessage(bot, testMessage("u1"))
+	if got := d.getStep("u1"); got != second {
+		t.Fatalf("step after next = %p, want the second step %p", got, second)
+	}
+	d.HandleMessage(bot, testMessage("u1"))
+	if first.processed != 1 || second.processed != 1 {
+		t.Errorf("processed = %d, %d, want 1, 1", first.processed, second.processed)
+	}
+}
+
+func TestDialogSetStateRejectsSharedNames(t *testing.T) {
+	d := NewDialog()
+	d.SetBeginStep(&countStep{})
+	if err := d.SetState(NewMemoryDialogState(memory.New("ephemeral"))); err == nil {
+		t.Error("SetState() with a step without a name = nil, want an error")
+	}
+
+	d = NewDialog()
+	d.AddSteps(&namedStep{name: "a"}, &namedStep{name: "a"})
+	if err := d.SetState(NewMemoryDialogState(memory.New("ephemeral"))); err == nil {
+		t.Error("SetState() with steps sharing a name = nil, want an error")
+	}
+
+	d = NewDialog()
+	d.AddSteps(&namedStep{name: "a"}, &namedStep{name: "b"})
+	if err := d.SetState(NewMemoryDialogState(memory.New("ephemeral"))); err != nil {
+		t.Errorf("SetState() with named steps = %v, want nil", err)
+	}
+	for _, s := range []Step{&countStep{}, &namedStep{name: "a"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AddSteps(%q) after SetState did not panic", s.Name())
+				}
+			}()
+			d.AddSteps(s)
+		}()
+	}
+}
+
+func TestDialogMoveRegistersStep(t *testing.T) {
+	bot := newTestBot()
+	begin, end := &namedStep{name: "begin"}, &namedStep{name: "end"}
+	detour := &countStep{}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+
+	d.HandleMessage(bot, testMessage("u1"))
+	d.Move(bot, testMessage("u1"), detour)
+	d.HandleMessage(bot, testMessage("u1"))
+	if detour.processed != 1 {
+		t.Errorf("processed = %d after Move to an unregistered step, want 1", detour.processed)
+	}
+	if got := d.state.PopHistory("u1"); got != "begin" {
+		t.Errorf("history = %q after Move, want the begin step", got)
+	}
+}
+
+func TestMemoryDialogStateConcurrentHistory(t *testing.T) {
+	state := NewMemoryDialogState(memory.New("ephemeral"))
+	var wg sync.WaitGroup
+	for i := 0; i < MaxDialogHistory; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state.PushHistory("u1", fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for name := state.PopHistory("u1"); name != ""; name = state.PopHistory("u1") {
+		seen[name] = true
+	}
+	if len(seen) != MaxDialogHistory {
+		t.Errorf("history has %d steps after concurrent pushes, want %d", len(seen), MaxDialogHistory)
+	}
+}
+
+// blockingStep is a step whose Process signals started and waits for release.
+type blockingStep struct {
+	BaseStep
+	started, release chan struct{}
+}
+
+func (s *blockingStep) Name() string { return "blocking" }
+
+func (s *blockingStep) Process(bot *Bot, msg *Message) Event {
+	s.started <- struct{}{}
+	<-s.release
+	return NilEvent
+}
+
+func TestDialogMoveAndResetWaitForHandling(t *testing.T) {
+	bot := newTestBot()
+	step := &blockingStep{started: make(chan struct{}), release: make(chan struct{})}
+	other, end := &namedStep{name: "other"}, &namedStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(step)
+	d.SetEndStep(end)
+	d.AddSteps(other)
+	d.HandleMessage(bot, testMessage("u1")) // enters the blocking step
+
+	for _, call := range []struct {
+		name string
+		f    func()
+		want Step
+	}{
+		{"Move", func() { d.Move(bot, testMessage("u1"), other) }, other},
+		{"Reset", func() { d.Reset("u1") }, nil},
+	} {
+		d.setStep("u1", step)
+		handled := make(chan struct{})
+		go func() {
+			d.HandleMessage(bot, testMessage("u1"))
+			close(handled)
+		}()
+		<-step.started
+
+		done := make(chan struct{})
+		go func() {
+			call.f()
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Errorf("%s returned while a message of the user was being handled", call.name)
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(step.release)
+		<-handled
+		<-done
+		step.release = make(chan struct{})
+		if got := d.getStep("u1"); got != call.want {
+			t.Errorf("step after %s = %v, want %v", call.name, got, call.want)
+		}
+	}
+}
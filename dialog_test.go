@@ -0,0 +1,169 @@
+package fbbot
+
+import (
+	"testing"
+	"time"
+)
+
+// inputStep is a step saving the last message it processes.
+type inputStep struct {
+	BaseStep
+	msg *Message
+}
+
+func (s *inputStep) Process(bot *Bot, msg *Message) Event {
+	s.msg = msg
+	return NilEvent
+}
+
+// scriptStep is a named step counting its calls, whose Enter and Process emit the given events.
+type scriptStep struct {
+	name                     string
+	enter, process           Event
+	entered, processed, left int
+}
+
+func (s *scriptStep) Name() string { return s.name }
+
+func (s *scriptStep) Enter(bot *Bot, msg *Message) Event {
+	s.entered++
+	return s.enter
+}
+
+func (s *scriptStep) Process(bot *Bot, msg *Message) Event {
+	s.processed++
+	return s.process
+}
+
+func (s *scriptStep) Leave(bot *Bot, msg *Message) Event {
+	s.left++
+	return NilEvent
+}
+
+func TestDialogTypedInput(t *testing.T) {
+	bot := newTestBot()
+	begin, end := &inputStep{}, &inputStep{}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+	d.AddSteps(begin, end)
+	sender := User{ID: "u1", platform: PlatformInstagram}
+	d.HandleMessage(bot, &Message{Sender: sender}) // enters the begin step
+
+	d.HandlePostback(bot, &Postback{Sender: sender, Platform: PlatformInstagram, Payload: "BUY"})
+	if msg := begin.msg; msg.Kind() != InputPostback || msg.Payload() != "BUY" || msg.Text != "BUY" || msg.Platform != PlatformInstagram {
+		t.Errorf("postback message = %+v, want kind postback, payload and text BUY on Instagram", msg)
+	}
+
+	d.HandleOptin(bot, &Optin{Sender: sender, Ref: "plugin"})
+	if msg := begin.msg; msg.Kind() != InputOptin || msg.Platform != PlatformInstagram {
+		t.Errorf("optin message = %+v, want kind optin on Instagram", msg)
+	}
+
+	d.HandleReferral(bot, &Referral{Sender: sender, Ref: "ad"})
+	if msg := begin.msg; msg.Kind() != InputReferral || msg.Platform != PlatformInstagram {
+		t.Errorf("referral message = %+v, want kind referral on Instagram", msg)
+	}
+}
+
+func TestDialogGuardedTransitions(t *testing.T) {
+	deny := func(*Bot, *Message) bool { return false }
+	allow := func(*Bot, *Message) bool { return true }
+	tests := []struct {
+		name   string
+		guards []Guard // of transitions to the steps "a" and "b", before the unguarded one to "c"
+		want   string
+	}{
+		{"first allowed", []Guard{allow, allow}, "a"},
+		{"false guard falls through", []Guard{deny, allow}, "b"},
+		{"all denied", []Guard{deny, deny}, "c"},
+	}
+	for _, tt := range tests {
+		bot := newTestBot()
+		begin, end := &scriptStep{name: "begin", process: "go"}, &scriptStep{name: "end"}
+		d := NewDialog()
+		d.SetBeginStep(begin)
+		d.SetEndStep(end)
+		d.AddTransition("go", begin, &scriptStep{name: "c"})
+		d.AddGuardedTransition("go", tt.guards[0], begin, &scriptStep{name: "a"})
+		d.AddGuardedTransition("go", tt.guards[1], begin, &scriptStep{name: "b"})
+
+		d.HandleMessage(bot, testMessage("u1"))
+		d.HandleMessage(bot, testMessage("u1"))
+		if got := d.getStep("u1"); got == nil || got.Name() != tt.want {
+			t.Errorf("%s: step = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDialogMaxTransitions(t *testing.T) {
+	bot := newTestBot()
+	begin, end := &scriptStep{name: "begin", process: "go"}, &scriptStep{name: "end"}
+	ping, pong := &scriptStep{name: "ping", enter: "bounce"}, &scriptStep{name: "pong", enter: "bounce"}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+	d.MaxTransitions = 5
+	d.AddTransition("go", begin, ping)
+	d.AddTransition("bounce", ping, pong)
+	d.AddTransition("bounce", pong, ping)
+
+	d.HandleMessage(bot, testMessage("u1"))
+	done := make(chan struct{})
+	go func() {
+		d.HandleMessage(bot, testMessage("u1"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a transition loop did not stop")
+	}
+	if n := ping.entered + pong.entered; n != d.MaxTransitions {
+		t.Errorf("entered %d steps, want MaxTransitions %d", n, d.MaxTransitions)
+	}
+	if got := d.getStep("u1"); got != ping {
+		t.Errorf("step after the limit = %v, want the last step entered", got)
+	}
+}
+
+func TestDialogTimeoutExpires(t *testing.T) {
+	bot := newTestBot()
+	begin, end := &scriptStep{name: "begin"}, &scriptStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+	d.Timeout = 20 * time.Millisecond
+	expired := make(chan User, 1)
+	d.ExpireHook = func(bot *Bot, u User) { expired <- u }
+
+	d.HandleMessage(bot, testMessage("u1"))
+	d.Memory(bot).For("u1").Set("answer", "42")
+	select {
+	case u := <-expired:
+		if u.ID != "u1" {
+			t.Errorf("ExpireHook called for %q, want u1", u.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ExpireHook was not called after Timeout")
+	}
+
+	if got := d.getStep("u1"); got != nil {
+		t.Errorf("step after the timeout = %v, want none", got)
+	}
+	if got := d.Memory(bot).For("u1").Get("answer"); got != "" {
+		t.Errorf("memory after the timeout = %q, want it cleared", got)
+	}
+	d.mutex.Lock()
+	_, timer := d.timers["u1"]
+	d.mutex.Unlock()
+	if timer {
+		t.Error("the timer of the user is kept after it expired")
+	}
+
+	d.HandleMessage(bot, testMessage("u1"))
+	if got := d.getStep("u1"); got != begin {
+		t.Errorf("step after a new message = %v, want the begin step", got)
+	}
+	d.Reset("u1")
+}
@@ -0,0 +1,264 @@
+package fbbot
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michlabs/fbbot/memory"
+)
+
+// Events emitted by a FormStep
+const (
+	FormDoneEvent   Event = "done"   // all fields are filled
+	FormFailedEvent Event = "failed" // a field is answered wrongly more than its MaxRetries
+)
+
+// Keys the progress of a form is saved under
+const (
+	formFieldKey   = "field"
+	formRetriesKey = "retries"
+)
+
+// Validator checks an answer and returns the value to save.
+// Its error is sent to the user if the field has no ErrorMessage.
+type Validator func(*Message) (string, error)
+
+// FormField is a question of a FormStep.
+type FormField struct {
+	Name         string             // key the value is saved under
+	Prompt       string             // question sent to the user
+	Options      []QuickRepliesItem // quick replies sent with the prompt
+	Validate     Validator          // ValidateText if nil
+	MaxRetries   int                // wrong answers allowed before the form fails, 0 means no limit
+	ErrorMessage string             // sent on wrong answers before the prompt is repeated
+}
+
+// FormStep asks the user its fields one by one, validates the answers and saves them in STMemory,
+// or in its namespace of STMemory if Namespace is set, e.g. the Namespace of the dialog.
+// It emits FormDoneEvent when all fields are filled, FormFailedEvent when a field is answered wrongly too many times.
+// The progress of the user is kept until the form is left, so entering it again goes on at the field he is at.
+type FormStep struct {
+	BaseStep
+	name      string
+	Fields    []*FormField
+	Namespace string
+}
+
+// NewFormStep returns a form step named name asking the fields.
+func NewFormStep(name string, fields ...*FormField) *FormStep {
+	return &FormStep{name: name, Fields: fields}
+}
+
+func (s *FormStep) Name() string {
+	return s.name
+}
+
+// Memory returns where values of the form are saved.
+func (s *FormStep) Memory(bot *Bot) memory.Memory {
+	if s.Namespace == "" {
+		return bot.STMemory
+	}
+	return bot.STMemory.Namespace(s.Namespace)
+}
+
+// Values returns the values the user has filled in.
+func (s *FormStep) Values(bot *Bot, u User) map[string]string {
+	store := s.Memory(bot).For(u.ID)
+	values := make(map[string]string)
+	for _, f := range s.Fields {
+		if v, ok := store.Lookup(f.Name); ok {
+			values[f.Name] = v
+		}
+	}
+	return values
+}
+
+// progress returns where the progress of the user in the form is saved,
+// next to the values so it is cleared with them when the dialog restarts.
+func (s *FormStep) progress(bot *Bot, u User) memory.Store {
+	return s.Memory(bot).Namespace("fbbot.form." + s.name).For(u.ID)
+}
+
+func (s *FormStep) Enter(bot *Bot, msg *Message) Event {
+	p := s.progress(bot, msg.Sender)
+	if field, ok := p.Lookup(formFieldKey); ok {
+		if i, _ := strconv.Atoi(field); i < len(s.Fields) {
+			return s.Resume(bot, msg)
+		}
+	}
+	p.SetMany(map[string]string{formFieldKey: "0", formRetriesKey: "0"})
+	if len(s.Fields) == 0 {
+		return FormDoneEvent
+	}
+	s.ask(bot, msg.Sender, s.Fields[0])
+	return NilEvent
+}
+
+// Resume asks the field the user is at again.
+func (s *FormStep) Resume(bot *Bot, msg *Message) Event {
+	i, _ := strconv.Atoi(s.progress(bot, msg.Sender).Get(formFieldKey))
+	if i >= len(s.Fields) {
+		return FormDoneEvent
+	}
+	s.ask(bot, msg.Sender, s.Fields[i])
+	return NilEvent
+}
+
+func (s *FormStep) Process(bot *Bot, msg *Message) Event {
+	p := s.progress(bot, msg.Sender)
+	i, _ := strconv.Atoi(p.Get(formFieldKey))
+	if i >= len(s.Fields) {
+		return FormDoneEvent
+	}
+	field := s.Fields[i]
+
+	validate := field.Validate
+	if validate == nil {
+		validate = ValidateText
+	}
+	value, err := validate(msg)
+	if err != nil {
+		retries, _ := p.Incr(formRetriesKey, 1)
+		if field.MaxRetries > 0 && int(retries) > field.MaxRetries {
+			s.reset(bot, msg.Sender)
+			return FormFailedEvent
+		}
+		text := field.ErrorMessage
+		if text == "" {
+			text = err.Error()
+		}
+		bot.SendText(msg.Sender, text)
+		s.ask(bot, msg.Sender, field)
+		return NilEvent
+	}
+
+	s.Memory(bot).For(msg.Sender.ID).Set(field.Name, value)
+	i++
+	p.SetMany(map[string]string{formFieldKey: strconv.Itoa(i), formRetriesKey: "0"})
+	if i >= len(s.Fields) {
+		return FormDoneEvent
+	}
+	s.ask(bot, msg.Sender, s.Fields[i])
+	return NilEvent
+}
+
+func (s *FormStep) Leave(bot *Bot, msg *Message) Event {
+	s.reset(bot, msg.Sender)
+	return NilEvent
+}
+
+// reset forgets the progress of the user, so the form starts over when he enters it again.
+func (s *FormStep) reset(bot *Bot, u User) {
+	p := s.progress(bot, u)
+	p.Delete(formFieldKey)
+	p.Delete(formRetriesKey)
+}
+
+func (s *FormStep) ask(bot *Bot, u User, field *FormField) {
+	if len(field.Options) == 0 {
+		bot.SendText(u, field.Prompt)
+		return
+	}
+	bot.Send(u, &QuickRepliesMessage{Text: field.Prompt, Items: field.Options})
+}
+
+// answer returns the payload of the tapped quick reply or button if any, else the text of the message.
+func answer(msg *Message) string {
+	if payload := msg.Payload(); payload != "" {
+		return payload
+	}
+	return strings.TrimSpace(msg.Text)
+}
+
+// ValidateText accepts any non-empty answer.
+func ValidateText(msg *Message) (string, error) {
+	if v := answer(msg); v != "" {
+		return v, nil
+	}
+	return "", errors.New("Please type your answer.")
+}
+
+// ValidateEmail accepts an email address.
+func ValidateEmail(msg *Message) (string, error) {
+	addr, err := mail.ParseAddress(answer(msg))
+	if err != nil || addr.Name != "" {
+		return "", errors.New("Please enter a valid email address.")
+	}
+	return addr.Address, nil
+}
+
+var phoneRegexp = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// ValidatePhone accepts a phone number, ignoring spaces, dots, dashes and parentheses.
+func ValidatePhone(msg *Message) (string, error) {
+	phone := strings.NewReplacer(" ", "", ".", "", "-", "", "(", "", ")", "").Replace(answer(msg))
+	if !phoneRegexp.MatchString(phone) {
+		return "", errors.New("Please enter a valid phone number.")
+	}
+	return phone, nil
+}
+
+// ValidateNumber accepts a number.
+func ValidateNumber(msg *Message) (string, error) {
+	v := answer(msg)
+	if _, err := strconv.ParseFloat(v, 64); err != nil {
+		return "", errors.New("Please enter a number.")
+	}
+	return v, nil
+}
+
+// ValidateDate returns a validator accepting a date in one of the layouts, "2006-01-02" if none is given.
+// Dates are saved as "2006-01-02".
+func ValidateDate(layouts ...string) Validator {
+	if len(layouts) == 0 {
+		layouts = []string{"2006-01-02"}
+	}
+	return func(msg *Message) (string, error) {
+		v := answer(msg)
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.Format("2006-01-02"), nil
+			}
+		}
+		return "", fmt.Errorf("Please enter a date like %s.", time.Now().Format(layouts[0]))
+	}
+}
+
+// ValidateLocation accepts a shared location, saved as "lat,long".
+func ValidateLocation(msg *Message) (string, error) {
+	c := msg.Location.Coordinates
+	if c.Lat == 0 && c.Long == 0 {
+		return "", errors.New("Please share your location.")
+	}
+	return strconv.FormatFloat(c.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(c.Long, 'f', -1, 64), nil
+}
+
+// ValidateImage accepts a photo, saved as its URL.
+func ValidateImage(msg *Message) (string, error) {
+	if len(msg.Images) == 0 {
+		return "", errors.New("Please send a photo.")
+	}
+	return msg.Images[0].URL, nil
+}
+
+// ValidateChoice returns a validator accepting one of the quick replies or buttons, tapped or typed by its title.
+// The payload of the choice is saved.
+func ValidateChoice(items ...QuickRepliesItem) Validator {
+	return func(msg *Message) (string, error) {
+		payload := msg.Payload()
+		for _, item := range items {
+			if payload != "" && payload == item.Payload {
+				return item.Payload, nil
+			}
+			if item.Title != "" && strings.EqualFold(strings.TrimSpace(msg.Text), item.Title) {
+				return item.Payload, nil
+			}
+		}
+		return "", errors.New("Please choose one of the options.")
+	}
+}
@@ -0,0 +1,117 @@
+package fbbot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	choice := ValidateChoice(QuickRepliesItem{Title: "Free", Payload: "FREE"}, QuickRepliesItem{Title: "Pro", Payload: "PRO"})
+	tests := []struct {
+		name     string
+		validate Validator
+		msg      Message
+		want     string
+		wantErr  bool
+	}{
+		{"text", ValidateText, Message{Text: "  hi "}, "hi", false},
+		{"text empty", ValidateText, Message{Text: " "}, "", true},
+		{"email", ValidateEmail, Message{Text: "alice@example.com"}, "alice@example.com", false},
+		{"email with name", ValidateEmail, Message{Text: "Alice <alice@example.com>"}, "", true},
+		{"email invalid", ValidateEmail, Message{Text: "alice"}, "", true},
+		{"phone", ValidatePhone, Message{Text: "+84 (912) 345-678"}, "+84912345678", false},
+		{"phone invalid", ValidatePhone, Message{Text: "12ab"}, "", true},
+		{"phone too short", ValidatePhone, Message{Text: "12345"}, "", true},
+		{"number", ValidateNumber, Message{Text: "3.5"}, "3.5", false},
+		{"number invalid", ValidateNumber, Message{Text: "three"}, "", true},
+		{"date", ValidateDate(), Message{Text: "2024-02-29"}, "2024-02-29", false},
+		{"date layout", ValidateDate("02/01/2006"), Message{Text: "29/02/2024"}, "2024-02-29", false},
+		{"date invalid", ValidateDate(), Message{Text: "2023-02-29"}, "", true},
+		{"location", ValidateLocation, Message{Location: Location{Coordinates{Lat: 10.5, Long: 106.75}}}, "10.5,106.75", false},
+		{"location missing", ValidateLocation, Message{Text: "Saigon"}, "", true},
+		{"image", ValidateImage, Message{Images: []Image{{URL: "https://example.com/a.jpg"}}}, "https://example.com/a.jpg", false},
+		{"image missing", ValidateImage, Message{Text: "a photo"}, "", true},
+		{"choice quick reply", choice, Message{Quickreply: Quickreply{Payload: "PRO"}}, "PRO", false},
+		{"choice postback", choice, Message{Postback: &Postback{Payload: "FREE"}}, "FREE", false},
+		{"choice title", choice, Message{Text: " free "}, "FREE", false},
+		{"choice unknown payload", choice, Message{Quickreply: Quickreply{Payload: "GOLD"}}, "", true},
+		{"choice unknown title", choice, Message{Text: "gold"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.validate(&tt.msg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormStepErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		errorMessage string
+		answers      []string
+		wantEvent    Event
+		wantText     string
+	}{
+		{"validator error", 0, "", []string{"x"}, NilEvent, "Please enter a valid email address."},
+		{"error message", 0, "That is not an email.", []string{"x"}, NilEvent, "That is not an email."},
+		{"retries left", 2, "", []string{"x", "y"}, NilEvent, "Please enter a valid email address."},
+		{"retries exceeded", 2, "", []string{"x", "y", "z"}, FormFailedEvent, ""},
+		{"valid after retries", 2, "", []string{"x", "y", "alice@example.com"}, FormDoneEvent, ""},
+	}
+	for _, tt := range tests {
+		transport := &recordingTransport{}
+		restore := useTransport(transport)
+
+		bot := newTestBot()
+		form := NewFormStep("signup", &FormField{
+			Name:         "email",
+			Prompt:       "What is your email?",
+			Validate:     ValidateEmail,
+			MaxRetries:   tt.maxRetries,
+			ErrorMessage: tt.errorMessage,
+		})
+		form.Enter(bot, textMessage("u1", "hi"))
+		var event Event
+		for _, answer := range tt.answers {
+			event = form.Process(bot, textMessage("u1", answer))
+		}
+		if event != tt.wantEvent {
+			t.Errorf("%s: event = %q, want %q", tt.name, event, tt.wantEvent)
+		}
+		if tt.wantText != "" {
+			sent := transport.sent()
+			if len(sent) < 2 || !strings.Contains(sent[len(sent)-2], tt.wantText) {
+				t.Errorf("%s: sent %q, want %q before the prompt", tt.name, sent, tt.wantText)
+			}
+		}
+		restore()
+	}
+}
+
+func TestFormStepKeepsProgress(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	bot := newTestBot()
+	form := NewFormStep("signup",
+		&FormField{Name: "name", Prompt: "What is your name?"},
+		&FormField{Name: "email", Prompt: "What is your email?"},
+	)
+	form.Enter(bot, textMessage("u1", "hi"))
+	form.Process(bot, textMessage("u1", "Alice"))
+
+	form.Enter(bot, textMessage("u1", "hi")) // entered again without leaving
+	sent := transport.sent()
+	if last := sent[len(sent)-1]; !strings.Contains(last, "What is your email?") {
+		t.Errorf("prompt when entered again = %s, want the email question", last)
+	}
+
+	form.Leave(bot, textMessage("u1", "bye"))
+	form.Enter(bot, textMessage("u1", "hi"))
+	sent = transport.sent()
+	if last := sent[len(sent)-1]; !strings.Contains(last, "What is your name?") {
+		t.Errorf("prompt after leaving = %s, want the name question", last)
+	}
+}
@@ -0,0 +1,151 @@
+package fbbot
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// StepChange describes an user moving between steps of a dialog, passed to its step hooks.
+type StepChange struct {
+	User     User
+	From     Step          // step left, nil when the user starts the dialog
+	To       Step          // step entered, nil when the user leaves the dialog by Timeout or ResetEvent
+	Event    Event         // event causing the change, NilEvent if none, e.g. for interrupts and Move
+	Time     time.Time     // time of the change
+	Duration time.Duration // time the user spent in From, zero if unknown, e.g. after a restart of the process
+}
+
+// hooked reports whether any step hook is set.
+func (d *Dialog) hooked() bool {
+	return d.EnterHook != nil || d.LeaveHook != nil || d.TransitionHook != nil
+}
+
+// notify calls the step hooks for the user moving from src to dst by the event.
+// Either step may be nil.
+func (d *Dialog) notify(bot *Bot, u User, src Step, event Event, dst Step) {
+	if !d.hooked() {
+		return
+	}
+	now := time.Now()
+	change := StepChange{User: u, From: src, To: dst, Event: event, Time: now}
+
+	d.mutex.Lock()
+	if t, ok := d.entered[u.ID]; ok && src != nil {
+		change.Duration = now.Sub(t)
+	}
+	if dst != nil {
+		d.entered[u.ID] = now
+	} else {
+		delete(d.entered, u.ID)
+	}
+	d.mutex.Unlock()
+
+	if src != nil && d.LeaveHook != nil {
+		d.LeaveHook(bot, change)
+	}
+	if d.TransitionHook != nil {
+		d.TransitionHook(bot, change)
+	}
+	if dst != nil && d.EnterHook != nil {
+		d.EnterHook(bot, change)
+	}
+}
+
+// FunnelStep is the record of a step in a Funnel.
+type FunnelStep struct {
+	Step       string        `json:"step"`
+	Entered    int64         `json:"entered"`     // times users entered the step
+	Left       int64         `json:"left"`        // times users left the step for another one
+	DroppedOff int64         `json:"dropped_off"` // times users left the dialog at the step, by Timeout or ResetEvent
+	Current    int64         `json:"current"`     // users at the step now, as far as the funnel knows
+	Conversion float64       `json:"conversion"`  // Entered divided by Entered of the first step entered
+	TotalTime  time.Duration `json:"-"`
+	AvgSeconds float64       `json:"avg_seconds"` // average time spent at the step by users who left it
+}
+
+// Funnel counts how many users reached each step of a dialog, where they drop off and how long they stay.
+// Set Record as TransitionHook of the dialog to use it:
+//
+//	funnel := fbbot.NewFunnel()
+//	dialog.TransitionHook = funnel.Record
+//
+// A funnel is kept in memory, export it by WriteJSON.
+type Funnel struct {
+	mutex sync.Mutex
+	steps map[string]*FunnelStep
+	order []string // step names in the order they are first entered
+}
+
+func NewFunnel() *Funnel {
+	return &Funnel{steps: make(map[string]*FunnelStep)}
+}
+
+// Record records the step change.
+func (f *Funnel) Record(bot *Bot, c StepChange) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if c.From != nil {
+		s := f.step(c.From.Name())
+		if c.To != nil {
+			s.Left++
+		} else {
+			s.DroppedOff++
+		}
+		s.TotalTime += c.Duration
+	}
+	if c.To != nil {
+		f.step(c.To.Name()).Entered++
+	}
+}
+
+// step returns the record of the step, creating it. It must be called with the mutex held.
+func (f *Funnel) step(name string) *FunnelStep {
+	s, ok := f.steps[name]
+	if !ok {
+		s = &FunnelStep{Step: name}
+		f.steps[name] = s
+		f.order = append(f.order, name)
+	}
+	return s
+}
+
+// Steps returns the records of the steps in the order they are first entered.
+func (f *Funnel) Steps() []FunnelStep {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	steps := make([]FunnelStep, 0, len(f.order))
+	var first int64
+	for _, name := range f.order {
+		s := *f.steps[name]
+		if first == 0 {
+			first = s.Entered
+		}
+		s.Current = s.Entered - s.Left - s.DroppedOff
+		if first > 0 {
+			s.Conversion = float64(s.Entered) / float64(first)
+		}
+		if n := s.Left + s.DroppedOff; n > 0 {
+			s.AvgSeconds = s.TotalTime.Seconds() / float64(n)
+		}
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// Reset clears the records.
+func (f *Funnel) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.steps = make(map[string]*FunnelStep)
+	f.order = nil
+}
+
+// WriteJSON writes the records of the steps as a JSON array.
+func (f *Funnel) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(f.Steps())
+}
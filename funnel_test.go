@@ -0,0 +1,107 @@
+package fbbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// changeNames returns names of the steps of the change, "-" for nil.
+func changeNames(c StepChange) (string, string) {
+	from, to := "-", "-"
+	if c.From != nil {
+		from = c.From.Name()
+	}
+	if c.To != nil {
+		to = c.To.Name()
+	}
+	return from, to
+}
+
+func TestDialogStepHooks(t *testing.T) {
+	bot := newTestBot()
+	begin := &scriptStep{name: "begin", process: "next"}
+	ask := &scriptStep{name: "ask", process: "done"}
+	end := &scriptStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+	d.AddTransition("next", begin, ask)
+	d.AddTransition("done", ask, end)
+
+	var transitions, entered, left []StepChange
+	d.TransitionHook = func(bot *Bot, c StepChange) { transitions = append(transitions, c) }
+	d.EnterHook = func(bot *Bot, c StepChange) { entered = append(entered, c) }
+	d.LeaveHook = func(bot *Bot, c StepChange) { left = append(left, c) }
+
+	for i := 0; i < 3; i++ {
+		d.HandleMessage(bot, testMessage("u1"))
+	}
+	want := []struct {
+		from, to string
+		event    Event
+	}{
+		{"-", "begin", NilEvent},
+		{"begin", "ask", "next"},
+		{"ask", "end", "done"},
+	}
+	if len(transitions) != len(want) {
+		t.Fatalf("TransitionHook called %d times, want %d", len(transitions), len(want))
+	}
+	for i, w := range want {
+		c := transitions[i]
+		if from, to := changeNames(c); from != w.from || to != w.to || c.Event != w.event || c.User.ID != "u1" {
+			t.Errorf("change %d = %s -%s-> %s of %s, want %s -%s-> %s", i, from, c.Event, to, c.User.ID, w.from, w.event, w.to)
+		}
+	}
+	if len(entered) != 3 || len(left) != 2 {
+		t.Errorf("EnterHook called %d times and LeaveHook %d times, want 3 and 2", len(entered), len(left))
+	}
+}
+
+func TestFunnel(t *testing.T) {
+	a, b, c := &namedStep{name: "a"}, &namedStep{name: "b"}, &namedStep{name: "c"}
+	f := NewFunnel()
+	for _, change := range []StepChange{
+		{From: nil, To: a},
+		{From: a, To: b, Duration: 2 * time.Second},
+		{From: b, To: c, Duration: 4 * time.Second},
+		{From: nil, To: a},
+		{From: a, To: b, Duration: 4 * time.Second},
+		{From: b, To: nil, Duration: 2 * time.Second}, // dropped off
+		{From: nil, To: a},
+	} {
+		f.Record(nil, change)
+	}
+
+	want := []FunnelStep{
+		{Step: "a", Entered: 3, Left: 2, Current: 1, Conversion: 1, AvgSeconds: 3},
+		{Step: "b", Entered: 2, Left: 1, DroppedOff: 1, Current: 0, Conversion: 2.0 / 3, AvgSeconds: 3},
+		{Step: "c", Entered: 1, Current: 1, Conversion: 1.0 / 3},
+	}
+	var buf bytes.Buffer
+	if err := f.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got []FunnelStep
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("WriteJSON() = %d steps, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Step != w.Step || g.Entered != w.Entered || g.Left != w.Left || g.DroppedOff != w.DroppedOff ||
+			g.Current != w.Current || math.Abs(g.Conversion-w.Conversion) > 1e-9 || math.Abs(g.AvgSeconds-w.AvgSeconds) > 1e-9 {
+			t.Errorf("step %d = %+v, want %+v", i, g, w)
+		}
+	}
+
+	f.Reset()
+	if steps := f.Steps(); len(steps) != 0 {
+		t.Errorf("Steps() after Reset = %v, want none", steps)
+	}
+}
@@ -3,6 +3,10 @@ module github.com/michlabs/fbbot
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/gomodule/redigo v1.8.2
 	github.com/michlabs/gowit v0.0.0-20170321081358-942431dda653
 	github.com/sirupsen/logrus v1.6.0
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v2 v2.4.0
 )
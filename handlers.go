@@ -16,6 +16,10 @@ type OptinHandler interface {
 	HandleOptin(*Bot, *Optin)
 }
 
+type ReferralHandler interface {
+	HandleReferral(*Bot, *Referral)
+}
+
 type ReadHandler interface {
 	HandleRead(*Bot, *Read)
 }
@@ -4,6 +4,7 @@ package fbbot
 type Message struct {
 	ID         string
 	Page       Page
+	Platform   Platform
 	Sender     User
 	Text       string
 	IsEcho     bool
@@ -16,6 +17,71 @@ type Message struct {
 	Seq        int
 	Timestamp  int64
 	Quickreply Quickreply
+
+	// Instagram only
+	StoryMentions []StoryMention
+	StoryReply    StoryReply
+
+	// Set when a postback, an optin or a referral is handled by a dialog as a message
+	Postback *Postback
+	Optin    *Optin
+	Referral *Referral
+
+	emitted   interface{} // data of the event emitted by the current step
+	eventData interface{} // data of the event that led to the current step
+}
+
+// Emit attaches data to the event a step emits, e.g. return msg.Emit("selected", product).
+// Guards of the transitions and the next step read it by EventData.
+func (m *Message) Emit(event Event, data interface{}) Event {
+	m.emitted = data
+	return event
+}
+
+// EventData returns the data attached by Emit to the event that led to the current step,
+// or nil if the event has none.
+func (m *Message) EventData() interface{} {
+	return m.eventData
+}
+
+// InputKind is the kind of input a message carries.
+type InputKind string
+
+const (
+	InputText       InputKind = "text"
+	InputQuickReply InputKind = "quick_reply"
+	InputPostback   InputKind = "postback"
+	InputAttachment InputKind = "attachment"
+	InputLocation   InputKind = "location"
+	InputOptin      InputKind = "optin"
+	InputReferral   InputKind = "referral"
+)
+
+// Kind returns the kind of input the message carries, e.g. to accept only a button press in a step.
+func (m *Message) Kind() InputKind {
+	switch {
+	case m.Postback != nil:
+		return InputPostback
+	case m.Optin != nil:
+		return InputOptin
+	case m.Referral != nil:
+		return InputReferral
+	case m.Quickreply.Payload != "":
+		return InputQuickReply
+	case m.Location.Coordinates != Coordinates{}:
+		return InputLocation
+	case len(m.Images) > 0 || len(m.Videos) > 0 || len(m.Audios) > 0 || len(m.Files) > 0:
+		return InputAttachment
+	}
+	return InputText
+}
+
+// Payload returns the payload of the tapped quick reply or button, or "" if none is tapped.
+func (m *Message) Payload() string {
+	if m.Postback != nil {
+		return m.Postback.Payload
+	}
+	return m.Quickreply.Payload
 }
 
 type Quickreply struct {
@@ -48,10 +114,34 @@ type Coordinates struct {
 	Long float64
 }
 
+// StoryMention is an Instagram story that mentions your account.
+type StoryMention struct {
+	URL string
+}
+
+// StoryReply is an Instagram story of your account that the message replies to.
+// ID is empty if the message is not a story reply.
+type StoryReply struct {
+	ID  string
+	URL string
+}
+
 // Postback
 type Postback struct {
-	Sender  User
-	Payload string `json:"payload"`
+	Sender   User
+	Platform Platform
+	Payload  string    `json:"payload"`
+	Referral *Referral `json:"referral"` // set when the user starts the conversation by an m.me link or an ad
+}
+
+// Referral
+// This callback will occur when the user enters an existing conversation by an m.me link, an ad or a QR code.
+type Referral struct {
+	Sender User
+	Ref    string `json:"ref"`    // ref parameter of the link
+	Source string `json:"source"` // e.g. SHORTLINK or ADS
+	Type   string `json:"type"`   // OPEN_THREAD
+	AdID   string `json:"ad_id"`  // set if Source is ADS
 }
 
 // Delivery
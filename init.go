@@ -1,6 +1,8 @@
 package fbbot
 
-var bot *Bot // For using outside bot's method, for example: in User struct
+import (
+	"time"
+)
 
 const (
 	WebhookURL      = "/webhook"
@@ -8,6 +10,14 @@ const (
 	APIEndpoint     = "https://graph.facebook.com/v2.6"
 	ProfileEndpoint = "https://graph.facebook.com/v2.6/me/messenger_profile"
 
+	CustomUserSettingsEndpoint = "https://graph.facebook.com/v2.6/me/custom_user_settings"
+
+	// Webhook server limits
+	DefaultMaxBodyBytes int64 = 1 << 20 // 1 MB
+	DefaultReadTimeout        = 10 * time.Second
+	DefaultWriteTimeout       = 10 * time.Second
+	DefaultIdleTimeout        = 60 * time.Second
+
 	// Notification type
 	NotiRegular    string = "REGULAR"     // will emit a sound/vibration and a phone notification
 	NotiSilentPush string = "SILENT_PUSH" // will just emit a phone notification
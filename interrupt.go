@@ -0,0 +1,125 @@
+package fbbot
+
+import (
+	"strings"
+
+	"github.com/michlabs/fbbot/nlp"
+)
+
+// Interrupt handles messages matching it at any step of a dialog, e.g. "help" or "cancel",
+// instead of the current step. After Handle is called, the user is moved back to the step he left last
+// if Back is set, else moved to Abort if it is set, else the current step is resumed to repeat its prompt, see Resumer.
+// Interrupts only apply to users in the middle of the dialog.
+type Interrupt struct {
+	Match  func(*Message) bool  // reports whether the message triggers the interrupt
+	Handle func(*Bot, *Message) // optional, e.g. sends a help text
+	Abort  Step                 // step to move to instead of resuming, e.g. the end step for "cancel"
+	Back   bool                 // go back to the previous step
+}
+
+// Resumer is implemented by steps keeping progress, e.g. FormStep and SubDialogStep,
+// to repeat their prompt after an interrupt without starting over.
+// Steps not implementing it are entered again.
+type Resumer interface {
+	Resume(*Bot, *Message) Event
+}
+
+// resume repeats the prompt of the step the user is at.
+func resume(bot *Bot, msg *Message, step Step) Event {
+	if r, ok := step.(Resumer); ok {
+		return r.Resume(bot, msg)
+	}
+	return step.Enter(bot, msg)
+}
+
+// AddInterrupt adds an interrupt, which is checked before interrupts added after it.
+func (d *Dialog) AddInterrupt(i *Interrupt) {
+	if i.Abort != nil {
+		d.AddSteps(i.Abort)
+	}
+	d.interrupts = append(d.interrupts, i)
+}
+
+// AddBackInterrupt adds an interrupt moving the user back to the previous step on matching messages.
+func (d *Dialog) AddBackInterrupt(match func(*Message) bool) {
+	d.AddInterrupt(&Interrupt{Match: match, Back: true})
+}
+
+func (d *Dialog) interrupt(bot *Bot, msg *Message, step Step, i *Interrupt) (Event, bool) {
+	if i.Handle != nil {
+		i.Handle(bot, msg)
+	}
+
+	var dst Step
+	if i.Back {
+		if name := d.state.PopHistory(msg.Sender.ID); name != "" {
+			dst, _ = d.lookup(name)
+		}
+	} else if i.Abort != nil {
+		dst = i.Abort
+	}
+
+	if dst == nil || dst == step { // resume
+		return d.transition(bot, msg, step, resume(bot, msg, step))
+	}
+
+	step.Leave(bot, msg)
+	if !i.Back {
+		d.state.PushHistory(msg.Sender.ID, d.key(step))
+	}
+	d.notify(bot, msg.Sender, step, NilEvent, dst)
+	return d.enter(bot, msg, dst)
+}
+
+// MatchText matches messages whose text is one of texts, ignoring case and surrounding spaces.
+func MatchText(texts ...string) func(*Message) bool {
+	return func(msg *Message) bool {
+		text := strings.TrimSpace(msg.Text)
+		for _, t := range texts {
+			if strings.EqualFold(text, t) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchPayload matches messages whose quick reply or postback payload is one of payloads.
+// Postbacks handled by a dialog also have the payload as text, so MatchText matches them too.
+func MatchPayload(payloads ...string) func(*Message) bool {
+	return func(msg *Message) bool {
+		payload := msg.Payload()
+		for _, p := range payloads {
+			if payload != "" && payload == p {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchKind matches messages carrying one of the kinds of input.
+func MatchKind(kinds ...InputKind) func(*Message) bool {
+	return func(msg *Message) bool {
+		kind := msg.Kind()
+		for _, k := range kinds {
+			if kind == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchIntent matches messages whose intent detected by the nlp package is one of intents.
+func MatchIntent(intents ...string) func(*Message) bool {
+	return func(msg *Message) bool {
+		intent, _ := nlp.Detect(msg.Text)
+		for _, i := range intents {
+			if intent == i {
+				return true
+			}
+		}
+		return false
+	}
+}
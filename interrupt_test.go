@@ -0,0 +1,82 @@
+package fbbot
+
+import (
+	"strings"
+	"testing"
+)
+
+func textMessage(userID string, text string) *Message {
+	return &Message{Sender: User{ID: userID}, Text: text}
+}
+
+func TestInterruptResumesForm(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	bot := newTestBot()
+	form := NewFormStep("signup",
+		&FormField{Name: "name", Prompt: "What is your name?"},
+		&FormField{Name: "email", Prompt: "What is your email?", Validate: ValidateEmail},
+	)
+	end := &scriptStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(form)
+	d.SetEndStep(end)
+	d.AddTransition(FormDoneEvent, form, end)
+	d.AddInterrupt(&Interrupt{
+		Match:  MatchText("help"),
+		Handle: func(bot *Bot, msg *Message) { bot.SendText(msg.Sender, "Just answer the question.") },
+	})
+
+	d.HandleMessage(bot, textMessage("u1", "hi"))
+	d.HandleMessage(bot, textMessage("u1", "Alice"))
+	d.HandleMessage(bot, textMessage("u1", "help"))
+	sent := transport.sent()
+	if last := sent[len(sent)-1]; !strings.Contains(last, "What is your email?") {
+		t.Errorf("prompt after the interrupt = %s, want the email question", last)
+	}
+
+	d.HandleMessage(bot, textMessage("u1", "alice@example.com"))
+	if got := d.getStep("u1"); got != end {
+		t.Fatalf("step after the last answer = %v, want the end step", got)
+	}
+	values := form.Values(bot, User{ID: "u1"})
+	if values["name"] != "Alice" || values["email"] != "alice@example.com" {
+		t.Errorf("Values() = %v, want the name and email", values)
+	}
+}
+
+func TestInterruptResumesSubDialog(t *testing.T) {
+	bot := newTestBot()
+	a := &scriptStep{name: "a", process: "next"}
+	b := &scriptStep{name: "b", process: "next"}
+	c := &scriptStep{name: "c"}
+	child := NewDialog()
+	child.SetBeginStep(a)
+	child.SetEndStep(c)
+	child.AddTransition("next", a, b)
+	child.AddTransition("next", b, c)
+
+	sub := NewSubDialogStep("sub", child)
+	end := &scriptStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(sub)
+	d.SetEndStep(end)
+	d.AddTransition(DoneEvent, sub, end)
+	d.AddInterrupt(&Interrupt{Match: MatchText("help")})
+
+	d.HandleMessage(bot, textMessage("u1", "hi"))
+	d.HandleMessage(bot, textMessage("u1", "go"))
+	d.HandleMessage(bot, textMessage("u1", "help"))
+	if got := child.getStep("u1"); got != b {
+		t.Fatalf("sub-dialog step after the interrupt = %v, want b", got)
+	}
+	if a.entered != 1 || b.entered != 2 {
+		t.Errorf("entered a %d times and b %d times, want 1 and 2", a.entered, b.entered)
+	}
+
+	d.HandleMessage(bot, textMessage("u1", "go"))
+	if got := d.getStep("u1"); got != end {
+		t.Errorf("step after the sub-dialog ends = %v, want the end step", got)
+	}
+}
@@ -0,0 +1,372 @@
+package memory
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltMemory stores data in a bbolt database file, one bucket per user.
+// Every write is committed to disk before it returns,
+// so data survives restarts of single-instance deployments.
+type BoltMemory struct {
+	mutex sync.RWMutex // guards db, which is replaced by Compact
+	path  string
+	db    *bolt.DB
+}
+
+// NewBoltMemory opens the database file at path, creating it if it does not exist.
+func NewBoltMemory(path string) (*BoltMemory, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltMemory{path: path, db: db}, nil
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+func (bm *BoltMemory) For(id string) Store {
+	return &boltStore{memory: bm, bucket: []byte(id)}
+}
+
+func (bm *BoltMemory) Delete(id string) {
+	bm.update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(id))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (bm *BoltMemory) Namespace(name string) Memory {
+	return NewNamespace(bm, name)
+}
+
+func (bm *BoltMemory) Users() []string {
+	var ids []string
+	bm.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			ids = append(ids, string(name))
+			return nil
+		})
+	})
+	return ids
+}
+
+// Close closes the database file.
+func (bm *BoltMemory) Close() error {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	return bm.db.Close()
+}
+
+// Compact deletes expired keys and rewrites the database file to reclaim space left by deleted data.
+// Reads and writes wait until it is done.
+func (bm *BoltMemory) Compact() error {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	err := bm.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			return purgeBolt(b)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// The database is compacted into a new file, which replaces the old one only if everything succeeds,
+	// so the memory keeps working on the old database on errors.
+	tmpPath := bm.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := openBolt(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, bm.db, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := renameFile(tmpPath, bm.path); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	old := bm.db
+	bm.db = dst
+	if err := old.Close(); err != nil {
+		log.WithFields(log.Fields{"path": bm.path, "error": err}).Error("Failed to close compacted bolt memory")
+	}
+	return nil
+}
+
+// renameFile is os.Rename, replaced in tests.
+var renameFile = os.Rename
+
+func (bm *BoltMemory) snapshot() map[string]map[string]string {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+
+	data := make(map[string]map[string]string)
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			values := make(map[string]string)
+			data[string(name)] = values
+			return forEachBolt(b, func(k, v []byte) error {
+				values[string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"path": bm.path, "error": err}).Error("Failed to read bolt memory")
+	}
+	return data
+}
+
+func (bm *BoltMemory) view(f func(*bolt.Tx) error) {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+
+	if err := bm.db.View(f); err != nil {
+		log.WithFields(log.Fields{"path": bm.path, "error": err}).Error("Failed to read bolt memory")
+	}
+}
+
+func (bm *BoltMemory) update(f func(*bolt.Tx) error) error {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+
+	err := bm.db.Update(f)
+	if err != nil {
+		log.WithFields(log.Fields{"path": bm.path, "error": err}).Error("Failed to write bolt memory")
+	}
+	return err
+}
+
+// boltStore is data of an user, saved in the bucket
+type boltStore struct {
+	memory *BoltMemory
+	bucket []byte
+}
+
+func (bs *boltStore) Set(key string, value string) {
+	bs.SetWithTTL(key, value, 0)
+}
+
+func (bs *boltStore) SetWithTTL(key string, value string, ttl time.Duration) {
+	bs.memory.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bs.bucket)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		return setBoltTTL(b, []byte(key), ttl)
+	})
+}
+
+func (bs *boltStore) Get(key string) string {
+	value, _ := bs.Lookup(key)
+	return value
+}
+
+func (bs *boltStore) Delete(key string) {
+	bs.memory.update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bs.bucket); b != nil {
+			return deleteBoltKey(b, []byte(key))
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) Lookup(key string) (value string, ok bool) {
+	bs.memory.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bs.bucket); b != nil {
+			if v := getBolt(b, []byte(key)); v != nil {
+				value, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return value, ok
+}
+
+func (bs *boltStore) Keys() []string {
+	var keys []string
+	bs.memory.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bs.bucket); b != nil {
+			return forEachBolt(b, func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}
+		return nil
+	})
+	return keys
+}
+
+func (bs *boltStore) SetMany(values map[string]string) {
+	bs.memory.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bs.bucket)
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+			if err := setBoltTTL(b, []byte(k), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) Incr(key string, delta int64) (int64, error) {
+	var n int64
+	var parseErr error
+	err := bs.memory.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bs.bucket)
+		if err != nil {
+			return err
+		}
+		v, err := getBoltForUpdate(b, []byte(key))
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			if n, parseErr = strconv.ParseInt(string(v), 10, 64); parseErr != nil {
+				return nil // not a storage failure, nothing to log
+			}
+		}
+		n += delta
+		return b.Put([]byte(key), []byte(strconv.FormatInt(n, 10)))
+	})
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	return n, err
+}
+
+func (bs *boltStore) CompareAndSwap(key string, old string, new string) (swapped bool) {
+	bs.memory.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bs.bucket)
+		if err != nil {
+			return err
+		}
+		v, err := getBoltForUpdate(b, []byte(key))
+		if err != nil {
+			return err
+		}
+		if string(v) != old {
+			return nil
+		}
+		if err := b.Put([]byte(key), []byte(new)); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped
+}
+
+// ttlBucket is the bucket nested in an user bucket that holds deadlines of keys set with a TTL
+var ttlBucket = []byte("\x00ttl")
+
+// expiredBolt reports whether the TTL of the key has passed.
+func expiredBolt(b *bolt.Bucket, key []byte) bool {
+	t := b.Bucket(ttlBucket)
+	if t == nil {
+		return false
+	}
+	deadline := t.Get(key)
+	if deadline == nil {
+		return false
+	}
+	n, err := strconv.ParseInt(string(deadline), 10, 64)
+	return err == nil && time.Now().UnixNano() >= n
+}
+
+// getBolt returns value of the key, or nil if it does not exist or is expired.
+func getBolt(b *bolt.Bucket, key []byte) []byte {
+	if v := b.Get(key); v != nil && !expiredBolt(b, key) {
+		return v
+	}
+	return nil
+}
+
+// getBoltForUpdate is like getBolt, but also deletes the key if it is expired.
+// It must be called in a writable transaction.
+func getBoltForUpdate(b *bolt.Bucket, key []byte) ([]byte, error) {
+	if expiredBolt(b, key) {
+		return nil, deleteBoltKey(b, key)
+	}
+	return b.Get(key), nil
+}
+
+// forEachBolt calls f for each key/value that is not expired.
+func forEachBolt(b *bolt.Bucket, f func(k, v []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil || expiredBolt(b, k) { // v is nil for the TTL bucket
+			return nil
+		}
+		return f(k, v)
+	})
+}
+
+// setBoltTTL sets the TTL of the key, or removes it if ttl is zero.
+func setBoltTTL(b *bolt.Bucket, key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		if t := b.Bucket(ttlBucket); t != nil {
+			return t.Delete(key)
+		}
+		return nil
+	}
+	t, err := b.CreateBucketIfNotExists(ttlBucket)
+	if err != nil {
+		return err
+	}
+	return t.Put(key, []byte(strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10)))
+}
+
+func deleteBoltKey(b *bolt.Bucket, key []byte) error {
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	return setBoltTTL(b, key, 0)
+}
+
+// purgeBolt deletes all expired keys of the user bucket.
+func purgeBolt(b *bolt.Bucket) error {
+	t := b.Bucket(ttlBucket)
+	if t == nil {
+		return nil
+	}
+	var expired [][]byte
+	t.ForEach(func(k, _ []byte) error {
+		if expiredBolt(b, k) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	for _, k := range expired {
+		if err := deleteBoltKey(b, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
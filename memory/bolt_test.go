@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBolt returns a bolt memory in a temporary directory, and a function closing and removing it.
+func newTestBolt(t *testing.T) (*BoltMemory, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fbbot-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewBoltMemory(filepath.Join(dir, "memory.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return m, func() {
+		m.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	m, closeBolt := newTestBolt(t)
+	defer closeBolt()
+	testStore(t, m)
+}
+
+func TestBoltStoreTTL(t *testing.T) {
+	m, closeBolt := newTestBolt(t)
+	defer closeBolt()
+	testStoreTTL(t, m)
+}
+
+func TestBoltCompact(t *testing.T) {
+	m, closeBolt := newTestBolt(t)
+	defer closeBolt()
+
+	m.For("u1").Set("a", "1")
+	m.For("u2").Set("b", "2")
+	m.Delete("u2")
+	if err := m.Compact(); err != nil {
+		t.Fatalf("Compact() = %v", err)
+	}
+	if got := m.For("u1").Get("a"); got != "1" {
+		t.Errorf("Get() after Compact = %q, want 1", got)
+	}
+	m.For("u1").Set("c", "3")
+
+	path := m.path
+	m.Close()
+	reopened, err := NewBoltMemory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if a, c := reopened.For("u1").Get("a"), reopened.For("u1").Get("c"); a != "1" || c != "3" {
+		t.Errorf("values after reopening the compacted file = %q, %q, want 1, 3", a, c)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("temporary compaction file is left: %v", err)
+	}
+}
+
+func TestBoltCompactFailure(t *testing.T) {
+	m, closeBolt := newTestBolt(t)
+	defer closeBolt()
+	m.For("u1").Set("a", "1")
+
+	defer func(rename func(string, string) error) { renameFile = rename }(renameFile)
+	renameFile = func(string, string) error { return errors.New("disk full") }
+	if err := m.Compact(); err == nil {
+		t.Fatal("Compact() with a failing rename = nil, want an error")
+	}
+	if got := m.For("u1").Get("a"); got != "1" {
+		t.Errorf("Get() after a failed Compact = %q, want 1", got)
+	}
+	m.For("u1").Set("b", "2")
+
+	// the temporary file can not be created
+	renameFile = os.Rename
+	if err := os.MkdirAll(filepath.Join(m.path+".compact", "busy"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Compact(); err == nil {
+		t.Fatal("Compact() without a temporary file = nil, want an error")
+	}
+	if got := m.For("u1").Get("b"); got != "2" {
+		t.Errorf("Get() after a failed Compact = %q, want 2", got)
+	}
+}
@@ -0,0 +1,303 @@
+package memory
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptedPrefix marks values encrypted by EncryptedMemory,
+// followed by the key ID, ":" and the base64 encoded nonce and ciphertext.
+const encryptedPrefix = "enc:v1:"
+
+var ErrUnknownKey error = errors.New("Encryption key does not exist")
+
+// ErrNotEncrypted is returned for values read by an EncryptedMemory that are not encrypted,
+// unless its AllowPlaintext is set.
+var ErrNotEncrypted error = errors.New("Value is not encrypted")
+
+// KeyProvider provides AES keys of 16, 24 or 32 bytes, identified by IDs,
+// so keys can be rotated while values encrypted with older keys are still readable.
+// Key IDs must not contain ":".
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error) // key to encrypt new values with
+	Key(id string) ([]byte, error)                  // key to decrypt values encrypted with the key id
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys.
+type StaticKeys struct {
+	Current string            // ID of the key to encrypt new values with
+	Keys    map[string][]byte // maps key IDs to keys
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// EncryptedMemory encrypts values saved to the underlying memory with AES-GCM.
+// User IDs and keys are not encrypted, but values are bound to them,
+// so a value copied to another user or key can not be decrypted.
+// Values that are not encrypted, e.g. saved before the memory was wrapped, are reported as missing
+// unless AllowPlaintext is set, and are encrypted by Reencrypt.
+type EncryptedMemory struct {
+	// AllowPlaintext makes values that are not encrypted readable as they are, e.g. during a migration.
+	AllowPlaintext bool
+
+	memory Memory
+	keys   KeyProvider
+}
+
+// NewEncryptedMemory wraps the memory, encrypting values with keys from the provider.
+func NewEncryptedMemory(m Memory, keys KeyProvider) *EncryptedMemory {
+	return &EncryptedMemory{memory: m, keys: keys}
+}
+
+func (em *EncryptedMemory) For(id string) Store {
+	return &encryptedStore{memory: em, store: em.memory.For(id), id: id}
+}
+
+func (em *EncryptedMemory) Delete(id string) {
+	em.memory.Delete(id)
+}
+
+func (em *EncryptedMemory) Namespace(name string) Memory {
+	return NewNamespace(em, name)
+}
+
+func (em *EncryptedMemory) Users() []string {
+	return em.memory.Users()
+}
+
+// Reencrypt encrypts every value that is not encrypted with the current key, e.g. after a key rotation.
+// Values changed concurrently are left to the writer, TTLs are kept.
+func (em *EncryptedMemory) Reencrypt() error {
+	currentID, _, err := em.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	for _, id := range em.memory.Users() {
+		s := em.memory.For(id)
+		for _, key := range s.Keys() {
+			raw, ok := s.Lookup(key)
+			if !ok || strings.HasPrefix(raw, encryptedPrefix+currentID+":") {
+				continue
+			}
+			value, err := em.decrypt(id, key, raw, true)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s of %s: %v", key, id, err)
+			}
+			enc, err := em.encrypt(id, key, value)
+			if err != nil {
+				return err
+			}
+			s.CompareAndSwap(key, raw, enc)
+		}
+	}
+	return nil
+}
+
+// additionalData binds a value encrypted with the key id to the user and the key it is saved under.
+func additionalData(keyID string, userID string, key string) []byte {
+	return []byte(keyID + ":" + strconv.Quote(userID) + ":" + strconv.Quote(key))
+}
+
+func (em *EncryptedMemory) encrypt(userID string, key string, value string) (string, error) {
+	id, secret, err := em.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), additionalData(id, userID, key))
+	return encryptedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts the raw value of the key of the user. A missing value is "".
+// Values that are not encrypted are returned as they are if allowPlaintext is set.
+func (em *EncryptedMemory) decrypt(userID string, key string, raw string, allowPlaintext bool) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(raw, encryptedPrefix) {
+		if !allowPlaintext {
+			return "", ErrNotEncrypted
+		}
+		log.WithFields(log.Fields{"user": userID, "key": key}).Debug("Reading value that is not encrypted")
+		return raw, nil
+	}
+	parts := strings.SplitN(raw[len(encryptedPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+	id := parts[0]
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	secret, err := em.keys.Key(id)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	value, err := gcm.Open(nil, nonce, ciphertext, additionalData(id, userID, key))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedStore encrypts values saved to store of the user id
+type encryptedStore struct {
+	memory *EncryptedMemory
+	store  Store
+	id     string
+}
+
+func (es *encryptedStore) encrypt(key string, value string) (string, bool) {
+	enc, err := es.memory.encrypt(es.id, key, value)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to encrypt value")
+		return "", false
+	}
+	return enc, true
+}
+
+func (es *encryptedStore) decrypt(key string, raw string) (string, error) {
+	return es.memory.decrypt(es.id, key, raw, es.memory.AllowPlaintext)
+}
+
+func (es *encryptedStore) Set(key string, value string) {
+	if enc, ok := es.encrypt(key, value); ok {
+		es.store.Set(key, enc)
+	}
+}
+
+func (es *encryptedStore) SetWithTTL(key string, value string, ttl time.Duration) {
+	if enc, ok := es.encrypt(key, value); ok {
+		es.store.SetWithTTL(key, enc, ttl)
+	}
+}
+
+func (es *encryptedStore) SetMany(values map[string]string) {
+	encrypted := make(map[string]string, len(values))
+	for k, v := range values {
+		enc, ok := es.encrypt(k, v)
+		if !ok {
+			return
+		}
+		encrypted[k] = enc
+	}
+	es.store.SetMany(encrypted)
+}
+
+func (es *encryptedStore) Get(key string) string {
+	value, _ := es.Lookup(key)
+	return value
+}
+
+// Lookup reports values that can not be decrypted as missing.
+func (es *encryptedStore) Lookup(key string) (string, bool) {
+	raw, ok := es.store.Lookup(key)
+	if !ok {
+		return "", false
+	}
+	value, err := es.decrypt(key, raw)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("Failed to decrypt value")
+		return "", false
+	}
+	return value, true
+}
+
+func (es *encryptedStore) Delete(key string) {
+	es.store.Delete(key)
+}
+
+func (es *encryptedStore) Keys() []string {
+	return es.store.Keys()
+}
+
+// Incr is done by compare-and-swap, since encrypted values can not be added to by the backend.
+func (es *encryptedStore) Incr(key string, delta int64) (int64, error) {
+	for {
+		raw, _ := es.store.Lookup(key)
+		value, err := es.decrypt(key, raw)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		if value != "" {
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return 0, err
+			}
+		}
+		n += delta
+		enc, err := es.memory.encrypt(es.id, key, strconv.FormatInt(n, 10))
+		if err != nil {
+			return 0, err
+		}
+		if es.store.CompareAndSwap(key, raw, enc) {
+			return n, nil
+		}
+	}
+}
+
+func (es *encryptedStore) CompareAndSwap(key string, old string, new string) bool {
+	for {
+		raw, _ := es.store.Lookup(key)
+		value, err := es.decrypt(key, raw)
+		if err != nil {
+			log.WithFields(log.Fields{"key": key, "error": err}).Error("Failed to decrypt value")
+			return false
+		}
+		if value != old {
+			return false
+		}
+		enc, ok := es.encrypt(key, new)
+		if !ok {
+			return false
+		}
+		if es.store.CompareAndSwap(key, raw, enc) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKeys(current string) StaticKeys {
+	return StaticKeys{
+		Current: current,
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	testStore(t, NewEncryptedMemory(newTestEphemeral(t, EphemeralConfig{}), testKeys("k1")))
+}
+
+func TestEncryptedValuesAtRest(t *testing.T) {
+	raw := newTestEphemeral(t, EphemeralConfig{})
+	m := NewEncryptedMemory(raw, testKeys("k1"))
+	m.For("u").Set("phone", "+84123456789")
+
+	v := raw.For("u").Get("phone")
+	if !strings.HasPrefix(v, encryptedPrefix+"k1:") || strings.Contains(v, "123456789") {
+		t.Errorf("value at rest = %q, want it encrypted with k1", v)
+	}
+	if got := m.For("u").Get("phone"); got != "+84123456789" {
+		t.Errorf("Get() = %q", got)
+	}
+}
+
+func TestEncryptedValuesAreBoundToUserAndKey(t *testing.T) {
+	raw := newTestEphemeral(t, EphemeralConfig{})
+	m := NewEncryptedMemory(raw, testKeys("k1"))
+	m.For("alice").Set("phone", "+84123456789")
+	stolen := raw.For("alice").Get("phone")
+
+	raw.For("mallory").Set("phone", stolen)
+	raw.For("alice").Set("nickname", stolen)
+	if v, ok := m.For("mallory").Lookup("phone"); ok {
+		t.Errorf("value copied to another user decrypts to %q", v)
+	}
+	if v, ok := m.For("alice").Lookup("nickname"); ok {
+		t.Errorf("value copied to another key decrypts to %q", v)
+	}
+}
+
+func TestEncryptedPlaintext(t *testing.T) {
+	raw := newTestEphemeral(t, EphemeralConfig{})
+	raw.For("u").Set("name", "injected")
+	m := NewEncryptedMemory(raw, testKeys("k1"))
+
+	if v, ok := m.For("u").Lookup("name"); ok {
+		t.Errorf("plaintext value is read as %q by default", v)
+	}
+	m.AllowPlaintext = true
+	if v := m.For("u").Get("name"); v != "injected" {
+		t.Errorf("Get() = %q with AllowPlaintext", v)
+	}
+}
+
+func TestEncryptedReencrypt(t *testing.T) {
+	raw := newTestEphemeral(t, EphemeralConfig{})
+	old := NewEncryptedMemory(raw, testKeys("k1"))
+	old.For("u").Set("a", "1")
+	raw.For("u").Set("legacy", "plain")
+
+	m := NewEncryptedMemory(raw, testKeys("k2"))
+	if err := m.Reencrypt(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "1", "legacy": "plain"} {
+		if v := raw.For("u").Get(key); !strings.HasPrefix(v, encryptedPrefix+"k2:") {
+			t.Errorf("%s at rest = %q, want it encrypted with k2", key, v)
+		}
+		if v := m.For("u").Get(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestEncryptedNamespace(t *testing.T) {
+	m := NewEncryptedMemory(newTestEphemeral(t, EphemeralConfig{}), testKeys("k1"))
+	ns := m.Namespace("checkout")
+	ns.For("u").Set("card", "4111")
+	if v := ns.For("u").Get("card"); v != "4111" {
+		t.Errorf("Get() in namespace = %q", v)
+	}
+}
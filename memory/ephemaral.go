@@ -1,71 +1,378 @@
 package memory
 
 import (
+	"container/list"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type ephemeralMemory struct {
+// EphemeralConfig configures an ephemeral memory.
+type EphemeralConfig struct {
+	// MaxUsers, if not zero, limits the number of users kept.
+	// Least recently used users are evicted first.
+	MaxUsers int
+
+	// MaxKeys, if not zero, limits the total number of keys of all users,
+	// by evicting least recently used users.
+	MaxKeys int64
+
+	// SnapshotPath, if set, is a file the data is restored from when the memory is created
+	// and saved to by Save and Close. Keys set with a TTL are saved with their deadlines,
+	// and are not restored once expired.
+	SnapshotPath string
+}
+
+// EphemeralStats are counters of an ephemeral memory, for monitoring.
+type EphemeralStats struct {
+	Users     int   // number of users kept
+	Keys      int64 // total number of keys of all users
+	Evictions int64 // number of users evicted because of the limits
+}
+
+// EphemeralMemory stores data in RAM.
+// Limits are enforced when For is called, which also marks the user as recently used.
+type EphemeralMemory struct {
+	config EphemeralConfig
+
 	mutex   *sync.Mutex
-	mapping map[string]Store
+	mapping map[string]*list.Element // maps an user ID to his element in lru
+	lru     *list.List               // stores of users, the most recently used first
+
+	keys      int64 // accessed atomically
+	evictions int64 // accessed atomically
 }
 
-func newEphemeralMemory() *ephemeralMemory {
-	return &ephemeralMemory{
+// NewEphemeralMemory returns an ephemeral memory, restoring its data from config.SnapshotPath if the file exists.
+func NewEphemeralMemory(config EphemeralConfig) (*EphemeralMemory, error) {
+	em := &EphemeralMemory{
+		config:  config,
 		mutex:   &sync.Mutex{},
-		mapping: make(map[string]Store),
+		mapping: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if config.SnapshotPath != "" {
+		f, err := os.Open(config.SnapshotPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			defer f.Close()
+			if err := em.restore(f); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return em, nil
 }
 
-func (em ephemeralMemory) For(id string) Store {
+func (em *EphemeralMemory) For(id string) Store {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
 
-	es, ok := em.mapping[id]
-	if !ok {
-		s := newEphemeralStore()
-		em.mapping[id], es = s, s
+	e, ok := em.mapping[id]
+	if ok {
+		em.lru.MoveToFront(e)
+	} else {
+		e = em.lru.PushFront(newEphemeralStore(id, &em.keys))
+		em.mapping[id] = e
+	}
+	em.evict()
+	return e.Value.(*ephemeralStore)
+}
+
+// evict removes least recently used users until the limits are met,
+// always keeping the most recently used one. It must be called with the mutex held.
+func (em *EphemeralMemory) evict() {
+	for em.lru.Len() > 1 {
+		overUsers := em.config.MaxUsers > 0 && em.lru.Len() > em.config.MaxUsers
+		overKeys := em.config.MaxKeys > 0 && atomic.LoadInt64(&em.keys) > em.config.MaxKeys
+		if !overUsers && !overKeys {
+			return
+		}
+		em.remove(em.lru.Back())
+		atomic.AddInt64(&em.evictions, 1)
 	}
-	return es
 }
 
-func (em ephemeralMemory) Delete(id string) {
+// remove must be called with the mutex held.
+func (em *EphemeralMemory) remove(e *list.Element) {
+	es := e.Value.(*ephemeralStore)
+	em.lru.Remove(e)
+	delete(em.mapping, es.id)
+	es.detach()
+}
+
+func (em *EphemeralMemory) Delete(id string) {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
 
-	delete(em.mapping, id)
+	if e, ok := em.mapping[id]; ok {
+		em.remove(e)
+	}
+}
+
+func (em *EphemeralMemory) Namespace(name string) Memory {
+	return NewNamespace(em, name)
+}
+
+func (em *EphemeralMemory) Users() []string {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	ids := make([]string, 0, len(em.mapping))
+	for id := range em.mapping {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Stats returns the current counters of the memory.
+func (em *EphemeralMemory) Stats() EphemeralStats {
+	em.mutex.Lock()
+	users := em.lru.Len()
+	em.mutex.Unlock()
+
+	return EphemeralStats{
+		Users:     users,
+		Keys:      atomic.LoadInt64(&em.keys),
+		Evictions: atomic.LoadInt64(&em.evictions),
+	}
+}
+
+// Save writes all data to config.SnapshotPath, if set.
+func (em *EphemeralMemory) Save() error {
+	if em.config.SnapshotPath == "" {
+		return nil
+	}
+	tmpPath := em.config.SnapshotPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	data, expiries := em.snapshotWithExpiries()
+	if err := json.NewEncoder(f).Encode(ephemeralSnapshot{Data: data, Expiries: expiries}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, em.config.SnapshotPath)
+}
+
+// Close saves the data, call it when shutting down.
+func (em *EphemeralMemory) Close() error {
+	return em.Save()
+}
+
+// ephemeralSnapshot is the content of the snapshot file.
+type ephemeralSnapshot struct {
+	Data     map[string]map[string]string    `json:"data"`               // key/value data of users
+	Expiries map[string]map[string]time.Time `json:"expiries,omitempty"` // deadlines of keys set with a TTL
+}
+
+// restore sets data of the snapshot read from r.
+func (em *EphemeralMemory) restore(r io.Reader) error {
+	var snapshot ephemeralSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	for id, values := range snapshot.Data {
+		s := em.For(id)
+		for k, v := range values {
+			deadline, ok := snapshot.Expiries[id][k]
+			if !ok {
+				s.Set(k, v)
+			} else if ttl := deadline.Sub(now); ttl > 0 {
+				s.SetWithTTL(k, v, ttl)
+			}
+		}
+	}
+	return nil
+}
+
+func (em *EphemeralMemory) snapshot() map[string]map[string]string {
+	data, _ := em.snapshotWithExpiries()
+	return data
+}
+
+// snapshotWithExpiries returns data of all users, and deadlines of their keys set with a TTL.
+func (em *EphemeralMemory) snapshotWithExpiries() (map[string]map[string]string, map[string]map[string]time.Time) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	data := make(map[string]map[string]string)
+	expiries := make(map[string]map[string]time.Time)
+	for id, e := range em.mapping {
+		es := e.Value.(*ephemeralStore)
+		unlock := es.lock()
+		es.expireAll()
+		values := make(map[string]string, len(es.store))
+		for k, v := range es.store {
+			values[k] = v
+		}
+		if len(es.expiries) > 0 {
+			deadlines := make(map[string]time.Time, len(es.expiries))
+			for k, d := range es.expiries {
+				deadlines[k] = d
+			}
+			expiries[id] = deadlines
+		}
+		unlock()
+		data[id] = values
+	}
+	return data, expiries
 }
 
 // ephemeralStore is a memory that stores data in RAM
 // Just use it for development
 type ephemeralStore struct {
-	mutex *sync.Mutex
-	store map[string]string
+	id       string
+	mutex    *sync.Mutex
+	store    map[string]string
+	expiries map[string]time.Time // deadlines of keys set with a TTL
+	keys     *int64               // key counter of the memory, nil once the store is removed from it
 }
 
-func newEphemeralStore() Store {
+func newEphemeralStore(id string, keys *int64) *ephemeralStore {
 	return &ephemeralStore{
-		mutex: &sync.Mutex{},
-		store: make(map[string]string),
+		id:       id,
+		mutex:    &sync.Mutex{},
+		store:    make(map[string]string),
+		expiries: make(map[string]time.Time),
+		keys:     keys,
 	}
 }
 
-func (es ephemeralStore) Set(key string, value string) {
+// lock locks the store and returns the function unlocking it,
+// which adds the change of the number of keys to the memory's counter.
+func (es *ephemeralStore) lock() func() {
 	es.mutex.Lock()
-	defer es.mutex.Unlock()
+	n := len(es.store)
+	return func() {
+		if es.keys != nil {
+			atomic.AddInt64(es.keys, int64(len(es.store)-n))
+		}
+		es.mutex.Unlock()
+	}
+}
+
+// detach removes the store's keys from the memory's counter, once it is removed from the memory.
+func (es *ephemeralStore) detach() {
+	defer es.lock()()
+
+	atomic.AddInt64(es.keys, -int64(len(es.store)))
+	es.keys = nil
+}
+
+// expire deletes the key if its TTL has passed. It must be called with the mutex held.
+func (es *ephemeralStore) expire(key string) {
+	if deadline, ok := es.expiries[key]; ok && !time.Now().Before(deadline) {
+		delete(es.store, key)
+		delete(es.expiries, key)
+	}
+}
+
+// expireAll deletes all keys whose TTL has passed. It must be called with the mutex held.
+func (es *ephemeralStore) expireAll() {
+	for key := range es.expiries {
+		es.expire(key)
+	}
+}
+
+func (es *ephemeralStore) Set(key string, value string) {
+	defer es.lock()()
 
 	es.store[key] = value
+	delete(es.expiries, key)
 }
 
-func (es ephemeralStore) Get(key string) string {
-	es.mutex.Lock()
-	defer es.mutex.Unlock()
+func (es *ephemeralStore) SetWithTTL(key string, value string, ttl time.Duration) {
+	defer es.lock()()
+
+	es.store[key] = value
+	if ttl > 0 {
+		es.expiries[key] = time.Now().Add(ttl)
+	} else {
+		delete(es.expiries, key)
+	}
+}
+
+func (es *ephemeralStore) Get(key string) string {
+	defer es.lock()()
 
+	es.expire(key)
 	return es.store[key]
 }
 
-func (es ephemeralStore) Delete(key string) {
-	es.mutex.Lock()
-	defer es.mutex.Unlock()
+func (es *ephemeralStore) Delete(key string) {
+	defer es.lock()()
 
 	delete(es.store, key)
+	delete(es.expiries, key)
+}
+
+func (es *ephemeralStore) Lookup(key string) (string, bool) {
+	defer es.lock()()
+
+	es.expire(key)
+	value, ok := es.store[key]
+	return value, ok
+}
+
+func (es *ephemeralStore) Keys() []string {
+	defer es.lock()()
+
+	es.expireAll()
+	keys := make([]string, 0, len(es.store))
+	for k := range es.store {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (es *ephemeralStore) SetMany(values map[string]string) {
+	defer es.lock()()
+
+	for k, v := range values {
+		es.store[k] = v
+		delete(es.expiries, k)
+	}
+}
+
+func (es *ephemeralStore) Incr(key string, delta int64) (int64, error) {
+	defer es.lock()()
+
+	es.expire(key)
+	var n int64
+	if value, ok := es.store[key]; ok {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	n += delta
+	es.store[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (es *ephemeralStore) CompareAndSwap(key string, old string, new string) bool {
+	defer es.lock()()
+
+	es.expire(key)
+	if es.store[key] != old {
+		return false
+	}
+	es.store[key] = new
+	return true
 }
@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestEphemeral(t *testing.T, config EphemeralConfig) *EphemeralMemory {
+	t.Helper()
+	m, err := NewEphemeralMemory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestEphemeralStore(t *testing.T) {
+	testStore(t, newTestEphemeral(t, EphemeralConfig{}))
+}
+
+func TestEphemeralStoreTTL(t *testing.T) {
+	testStoreTTL(t, newTestEphemeral(t, EphemeralConfig{}))
+}
+
+func TestEphemeralKeyAccounting(t *testing.T) {
+	m := newTestEphemeral(t, EphemeralConfig{})
+	s := m.For("a")
+	s.Set("k1", "v")
+	s.Set("k1", "overwritten")
+	s.SetMany(map[string]string{"k2": "v", "k3": "v"})
+	s.Incr("k4", 1)
+	s.CompareAndSwap("k5", "", "v")
+	s.Delete("k2")
+	s.Delete("missing")
+	m.For("b").Set("k", "v")
+
+	if got := m.Stats(); got.Users != 2 || got.Keys != 5 {
+		t.Fatalf("Stats() = %+v, want 2 users and 5 keys", got)
+	}
+	m.Delete("a")
+	if got := m.Stats(); got.Users != 1 || got.Keys != 1 {
+		t.Errorf("Stats() after Delete() = %+v, want 1 user and 1 key", got)
+	}
+	s.Set("k6", "v") // store of a deleted user no longer counts
+	if got := m.Stats(); got.Keys != 1 {
+		t.Errorf("Stats() after writing a deleted store = %+v, want 1 key", got)
+	}
+}
+
+func TestEphemeralMaxUsers(t *testing.T) {
+	m := newTestEphemeral(t, EphemeralConfig{MaxUsers: 2})
+	m.For("a").Set("k", "v")
+	m.For("b").Set("k", "v")
+	m.For("a")               // a is now more recently used than b
+	m.For("c").Set("k", "v") // evicts b
+
+	if got := m.Stats(); got.Users != 2 || got.Keys != 2 || got.Evictions != 1 {
+		t.Errorf("Stats() = %+v, want 2 users, 2 keys and 1 eviction", got)
+	}
+	if v := m.For("a").Get("k"); v != "v" {
+		t.Error("recently used user is evicted")
+	}
+	if _, ok := m.mapping["b"]; ok {
+		t.Error("least recently used user is kept")
+	}
+}
+
+func TestEphemeralMaxKeys(t *testing.T) {
+	m := newTestEphemeral(t, EphemeralConfig{MaxKeys: 3})
+	m.For("a").SetMany(map[string]string{"1": "v", "2": "v"})
+	m.For("b").SetMany(map[string]string{"1": "v", "2": "v"})
+	m.For("b") // limits are enforced on For, evicting a
+
+	if got := m.Stats(); got.Users != 1 || got.Keys != 2 || got.Evictions != 1 {
+		t.Errorf("Stats() = %+v, want 1 user, 2 keys and 1 eviction", got)
+	}
+}
+
+func TestEphemeralSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot-ephemeral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := EphemeralConfig{SnapshotPath: filepath.Join(dir, "snapshot.json")}
+
+	m := newTestEphemeral(t, config)
+	m.For("u").Set("name", "alice")
+	m.For("u").SetWithTTL("session", "s", 100*time.Millisecond)
+	m.For("u").SetWithTTL("gone", "g", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestEphemeral(t, config)
+	s := restored.For("u")
+	if v := s.Get("name"); v != "alice" {
+		t.Errorf("name = %q, want alice", v)
+	}
+	if v := s.Get("session"); v != "s" {
+		t.Errorf("session = %q before its TTL, want s", v)
+	}
+	if _, ok := s.Lookup("gone"); ok {
+		t.Error("expired key is restored")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := s.Lookup("session"); ok {
+		t.Error("restored key does not expire")
+	}
+}
@@ -0,0 +1,25 @@
+package memory
+
+import (
+	"encoding/json"
+)
+
+// SetJSON saves v encoded as JSON by key.
+func SetJSON(s Store, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Set(key, string(data))
+	return nil
+}
+
+// GetJSON decodes the JSON value of key into v.
+// It returns false if the key does not exist, leaving v untouched.
+func GetJSON(s Store, key string, v interface{}) (bool, error) {
+	data, ok := s.Lookup(key)
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(data), v)
+}
@@ -0,0 +1,42 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var ErrNotExportable error = errors.New("Memory can not be exported")
+
+// snapshotter is a memory that can list all of its data
+type snapshotter interface {
+	// snapshot returns data of all users, mapping user ID to key/value data
+	snapshot() map[string]map[string]string
+}
+
+// ExportJSON writes all data of the memory to w as a JSON object
+// mapping user IDs to objects of their key/value data.
+// It can be used to move data between backends with ImportJSON.
+func ExportJSON(m Memory, w io.Writer) error {
+	s, ok := m.(snapshotter)
+	if !ok {
+		return ErrNotExportable
+	}
+	return json.NewEncoder(w).Encode(s.snapshot())
+}
+
+// ImportJSON reads data written by ExportJSON from r and saves it to the memory.
+// Existing keys are overwritten, other keys are kept.
+func ImportJSON(m Memory, r io.Reader) error {
+	var data map[string]map[string]string
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	for id, values := range data {
+		s := m.For(id)
+		for k, v := range values {
+			s.Set(k, v)
+		}
+	}
+	return nil
+}
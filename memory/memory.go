@@ -2,6 +2,7 @@ package memory
 
 import (
 	"errors"
+	"time"
 )
 
 var ErrMemoryType error = errors.New("Memory type does not exist")
@@ -11,20 +12,32 @@ type Memory interface {
 	// For returns memory of corresponding user
 	For(string) Store
 	Delete(string)
+	Users() []string // IDs of all users having data
+
+	// Namespace returns a view of the memory whose keys are isolated in the namespace,
+	// its Delete only deletes data in the namespace.
+	Namespace(string) Memory
 }
 
 // Store is a key/value data store
 type Store interface {
-	Set(string, string) // Save data for the user by key, value
-	Get(string) string  // Get data of the user that specified by key
-	Delete(string)      // Delete data of the user that specified by key
+	Set(string, string)                         // Save data for the user by key, value
+	SetWithTTL(string, string, time.Duration)   // Save data that is deleted after the TTL, zero TTL never expires; Set removes the TTL
+	Get(string) string                          // Get data of the user that specified by key
+	Delete(string)                              // Delete data of the user that specified by key
+	Lookup(string) (string, bool)               // Get data of the user and whether the key exists
+	Keys() []string                             // All keys of the user
+	SetMany(map[string]string)                  // Save several key/values at once
+	Incr(string, int64) (int64, error)          // Atomically add to the integer value of key, a missing key is 0, the TTL is kept
+	CompareAndSwap(string, string, string) bool // Atomically set key to new value if its value is old, a missing key is "", the TTL is kept
 }
 
+// New opens a memory of the type specified by name with default configuration.
+// It panics if the type is not registered or fails to open, use Open to handle the error.
 func New(name string) Memory {
-	switch name {
-	case "ephemeral":
-		return newEphemeralMemory()
-	default:
-		return newEphemeralMemory()
+	m, err := Open(name, nil)
+	if err != nil {
+		panic(err)
 	}
+	return m
 }
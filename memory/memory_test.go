@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore checks the Store contract on an empty store of the memory.
+func testStore(t *testing.T, m Memory) {
+	t.Helper()
+	s := m.For("user")
+
+	if _, ok := s.Lookup("missing"); ok {
+		t.Error("Lookup() of a missing key reports it exists")
+	}
+	s.Set("name", "alice")
+	if v := s.Get("name"); v != "alice" {
+		t.Errorf("Get() = %q, want %q", v, "alice")
+	}
+	s.Set("empty", "")
+	if v, ok := s.Lookup("empty"); !ok || v != "" {
+		t.Errorf("Lookup() of an empty value = %q, %v", v, ok)
+	}
+	s.SetMany(map[string]string{"a": "1", "b": "2"})
+	keys := s.Keys()
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "a,b,empty,name" {
+		t.Errorf("Keys() = %s", got)
+	}
+	s.Delete("empty")
+	if _, ok := s.Lookup("empty"); ok {
+		t.Error("deleted key still exists")
+	}
+
+	if n, err := s.Incr("count", 2); err != nil || n != 2 {
+		t.Errorf("Incr() of a missing key = %d, %v", n, err)
+	}
+	if n, err := s.Incr("count", -5); err != nil || n != -3 {
+		t.Errorf("Incr() = %d, %v, want -3", n, err)
+	}
+	if _, err := s.Incr("name", 1); err == nil {
+		t.Error("Incr() of a non integer succeeds")
+	}
+
+	if s.CompareAndSwap("name", "bob", "carol") {
+		t.Error("CompareAndSwap() with a wrong old value succeeds")
+	}
+	if !s.CompareAndSwap("name", "alice", "carol") || s.Get("name") != "carol" {
+		t.Error("CompareAndSwap() with the right old value fails")
+	}
+	if !s.CompareAndSwap("new", "", "x") || s.Get("new") != "x" {
+		t.Error("CompareAndSwap() from a missing key fails")
+	}
+
+	if ids := m.Users(); len(ids) != 1 || ids[0] != "user" {
+		t.Errorf("Users() = %v", ids)
+	}
+	m.Delete("user")
+	if keys := m.For("user").Keys(); len(keys) != 0 {
+		t.Errorf("Keys() after Delete() = %v", keys)
+	}
+}
+
+// testStoreTTL checks keys set with a TTL expire, and Set, Incr and CompareAndSwap handle the TTL.
+func testStoreTTL(t *testing.T, m Memory) {
+	t.Helper()
+	s := m.For("user")
+	ttl := 50 * time.Millisecond
+
+	s.SetWithTTL("session", "1", ttl)
+	s.SetWithTTL("counter", "1", ttl)
+	s.SetWithTTL("swapped", "a", ttl)
+	s.SetWithTTL("kept", "1", ttl)
+	s.Set("kept", "2") // Set removes the TTL
+	s.Incr("counter", 1)
+	s.CompareAndSwap("swapped", "a", "b")
+	if v := s.Get("session"); v != "1" {
+		t.Fatalf("Get() before the TTL = %q", v)
+	}
+
+	time.Sleep(2 * ttl)
+	for _, key := range []string{"session", "counter", "swapped"} {
+		if v, ok := s.Lookup(key); ok {
+			t.Errorf("%s = %q after its TTL", key, v)
+		}
+	}
+	if v := s.Get("kept"); v != "2" {
+		t.Errorf("kept = %q, want the value set without TTL", v)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "kept" {
+		t.Errorf("Keys() = %v, want only kept", keys)
+	}
+}
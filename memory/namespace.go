@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"strings"
+	"time"
+)
+
+// NamespaceDelimiter encloses the namespace prefixed to keys in the underlying store.
+// Keys starting with it are reserved for namespaces, so other keys never collide with namespaced ones.
+const NamespaceDelimiter = "\x00"
+
+// namespacedMemory is a view of a memory where keys of every user are prefixed with the namespace.
+type namespacedMemory struct {
+	memory Memory
+	prefix string
+}
+
+// NewNamespace returns a view of the memory whose keys are isolated in the namespace name.
+// Backends can implement Memory.Namespace by calling it.
+func NewNamespace(m Memory, name string) Memory {
+	if nm, ok := m.(*namespacedMemory); ok { // nested namespace
+		return &namespacedMemory{memory: nm.memory, prefix: nm.prefix + namespacePrefix(name)}
+	}
+	return &namespacedMemory{memory: m, prefix: namespacePrefix(name)}
+}
+
+func namespacePrefix(name string) string {
+	return NamespaceDelimiter + name + NamespaceDelimiter
+}
+
+func (nm *namespacedMemory) For(id string) Store {
+	return &namespacedStore{store: nm.memory.For(id), prefix: nm.prefix}
+}
+
+// Delete deletes data of the user in the namespace only.
+func (nm *namespacedMemory) Delete(id string) {
+	s := nm.For(id)
+	for _, key := range s.Keys() {
+		s.Delete(key)
+	}
+}
+
+// Users returns IDs of users having data in the namespace.
+func (nm *namespacedMemory) Users() []string {
+	var ids []string
+	for _, id := range nm.memory.Users() {
+		if len(nm.For(id).Keys()) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (nm *namespacedMemory) Namespace(name string) Memory {
+	return NewNamespace(nm, name)
+}
+
+// namespacedStore prefixes keys of store
+type namespacedStore struct {
+	store  Store
+	prefix string
+}
+
+func (ns *namespacedStore) Set(key string, value string) {
+	ns.store.Set(ns.prefix+key, value)
+}
+
+func (ns *namespacedStore) SetWithTTL(key string, value string, ttl time.Duration) {
+	ns.store.SetWithTTL(ns.prefix+key, value, ttl)
+}
+
+func (ns *namespacedStore) Get(key string) string {
+	return ns.store.Get(ns.prefix + key)
+}
+
+func (ns *namespacedStore) Delete(key string) {
+	ns.store.Delete(ns.prefix + key)
+}
+
+func (ns *namespacedStore) Lookup(key string) (string, bool) {
+	return ns.store.Lookup(ns.prefix + key)
+}
+
+func (ns *namespacedStore) Keys() []string {
+	var keys []string
+	for _, key := range ns.store.Keys() {
+		if strings.HasPrefix(key, ns.prefix) {
+			keys = append(keys, key[len(ns.prefix):])
+		}
+	}
+	return keys
+}
+
+func (ns *namespacedStore) SetMany(values map[string]string) {
+	prefixed := make(map[string]string, len(values))
+	for k, v := range values {
+		prefixed[ns.prefix+k] = v
+	}
+	ns.store.SetMany(prefixed)
+}
+
+func (ns *namespacedStore) Incr(key string, delta int64) (int64, error) {
+	return ns.store.Incr(ns.prefix+key, delta)
+}
+
+func (ns *namespacedStore) CompareAndSwap(key string, old string, new string) bool {
+	return ns.store.CompareAndSwap(ns.prefix+key, old, new)
+}
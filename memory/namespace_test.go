@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"testing"
+)
+
+func TestNamespaceStore(t *testing.T) {
+	testStore(t, newTestEphemeral(t, EphemeralConfig{}).Namespace("ns"))
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	m := newTestEphemeral(t, EphemeralConfig{})
+	root := m.For("u")
+	checkout := m.Namespace("checkout")
+	nested := checkout.Namespace("card")
+
+	root.Set("checkout/x", "root")
+	root.Set("x", "root")
+	checkout.For("u").Set("x", "checkout")
+	nested.For("u").Set("x", "card")
+	m.Namespace("other").For("u").Set("x", "other")
+
+	if v := root.Get("checkout/x"); v != "root" {
+		t.Errorf("root key = %q, it collides with a namespaced key", v)
+	}
+	if v := checkout.For("u").Get("x"); v != "checkout" {
+		t.Errorf("namespaced key = %q", v)
+	}
+	if v := nested.For("u").Get("x"); v != "card" {
+		t.Errorf("nested namespaced key = %q", v)
+	}
+
+	checkout.Delete("u")
+	if v := root.Get("checkout/x"); v != "root" {
+		t.Error("deleting the namespace deletes a root key")
+	}
+	if v := m.Namespace("other").For("u").Get("x"); v != "other" {
+		t.Error("deleting the namespace deletes another namespace")
+	}
+	if _, ok := nested.For("u").Lookup("x"); ok {
+		t.Error("deleting the namespace keeps its nested namespaces")
+	}
+}
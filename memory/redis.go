@@ -0,0 +1,279 @@
+package memory
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultRedisAddress = "localhost:6379"
+
+// RedisConfig configures a Redis memory.
+// Any server speaking the Redis protocol can be used, e.g. an in-process stand-in for testing.
+type RedisConfig struct {
+	Address  string // host:port of the server
+	Password string
+	DB       int
+
+	// Prefix is prepended to user IDs to make keys,
+	// so several memories can share a database.
+	Prefix string
+
+	// TTL, if not zero, expires data of an user that has not been written for this duration.
+	TTL time.Duration
+
+	// Connection pool
+	MaxIdle     int
+	MaxActive   int // 0 means no limit
+	IdleTimeout time.Duration
+}
+
+// redisMemory stores data of each user in a Redis hash
+type redisMemory struct {
+	pool   *redis.Pool
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisMemory returns a Memory backed by a Redis server.
+// Connections are made lazily, so it does not fail if the server is down.
+func NewRedisMemory(config RedisConfig) Memory {
+	address := config.Address
+	if address == "" {
+		address = DefaultRedisAddress
+	}
+	maxIdle := config.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 8
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address,
+				redis.DialPassword(config.Password),
+				redis.DialDatabase(config.DB),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return &redisMemory{
+		pool:   pool,
+		prefix: config.Prefix,
+		ttl:    config.TTL,
+	}
+}
+
+func (rm *redisMemory) For(id string) Store {
+	return &redisStore{memory: rm, key: rm.prefix + id}
+}
+
+func (rm *redisMemory) Delete(id string) {
+	rm.do("DEL", rm.prefix+id, rm.prefix+id+ttlSuffix)
+}
+
+// Namespace returns a view of the memory whose keys are prefixed in the hashes of users.
+func (rm *redisMemory) Namespace(name string) Memory {
+	return NewNamespace(rm, name)
+}
+
+// Users scans keys starting with the prefix,
+// so use a Prefix if the database holds other data.
+func (rm *redisMemory) Users() []string {
+	conn := rm.pool.Get()
+	defer conn.Close()
+
+	var ids []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", rm.prefix+"*", "COUNT", 100))
+		if err != nil {
+			log.WithFields(log.Fields{"command": "SCAN", "error": err}).Error("Redis command failed")
+			return ids
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			log.WithFields(log.Fields{"command": "SCAN", "error": err}).Error("Redis command failed")
+			return ids
+		}
+		for _, key := range keys {
+			if !strings.HasSuffix(key, ttlSuffix) {
+				ids = append(ids, key[len(rm.prefix):])
+			}
+		}
+		if cursor == 0 {
+			return ids
+		}
+	}
+}
+
+// Close closes all connections to the server.
+func (rm *redisMemory) Close() error {
+	return rm.pool.Close()
+}
+
+func (rm *redisMemory) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := rm.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do(cmd, args...)
+	if err != nil && err != redis.ErrNil {
+		log.WithFields(log.Fields{"command": cmd, "error": err}).Error("Redis command failed")
+	}
+	return reply, err
+}
+
+// redisStore is data of an user, saved in the hash at key.
+// Deadlines of fields set with a TTL are saved in the hash at key+ttlSuffix.
+type redisStore struct {
+	memory *redisMemory
+	key    string
+}
+
+const ttlSuffix = ":ttl"
+
+// Store scripts take the data hash and the TTL hash as keys,
+// the current time and the TTL of the hashes in milliseconds as first arguments,
+// then arguments of the operation. Expired fields are deleted before they are used.
+const scriptPrelude = `
+local function expire(f)
+	local d = redis.call('HGET', KEYS[2], f)
+	if d and tonumber(d) <= tonumber(ARGV[1]) then
+		redis.call('HDEL', KEYS[1], f)
+		redis.call('HDEL', KEYS[2], f)
+	end
+end
+local function touch()
+	if ARGV[2] ~= '0' then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		redis.call('PEXPIRE', KEYS[2], ARGV[2])
+	end
+end
+local function set(f, v, ttl)
+	redis.call('HSET', KEYS[1], f, v)
+	if ttl > 0 then
+		redis.call('HSET', KEYS[2], f, tonumber(ARGV[1]) + ttl)
+	else
+		redis.call('HDEL', KEYS[2], f)
+	end
+end
+`
+
+var (
+	// ARGV[3] field, ARGV[4] value, ARGV[5] TTL of the field
+	setScript = newStoreScript(`
+set(ARGV[3], ARGV[4], tonumber(ARGV[5]))
+touch()
+`)
+	// ARGV[3:] field, value pairs
+	setManyScript = newStoreScript(`
+for i = 3, #ARGV, 2 do set(ARGV[i], ARGV[i+1], 0) end
+touch()
+`)
+	// ARGV[3] field
+	getScript = newStoreScript(`
+expire(ARGV[3])
+return redis.call('HGET', KEYS[1], ARGV[3])
+`)
+	keysScript = newStoreScript(`
+for _, f in ipairs(redis.call('HKEYS', KEYS[2])) do expire(f) end
+return redis.call('HKEYS', KEYS[1])
+`)
+	// ARGV[3] field, ARGV[4] delta
+	incrScript = newStoreScript(`
+expire(ARGV[3])
+local n = redis.call('HINCRBY', KEYS[1], ARGV[3], ARGV[4])
+touch()
+return n
+`)
+	// ARGV[3] field, ARGV[4] old value, ARGV[5] new value
+	casScript = newStoreScript(`
+expire(ARGV[3])
+local v = redis.call('HGET', KEYS[1], ARGV[3])
+if v == false then v = '' end
+if v ~= ARGV[4] then return 0 end
+redis.call('HSET', KEYS[1], ARGV[3], ARGV[5])
+touch()
+return 1
+`)
+)
+
+func newStoreScript(src string) *redis.Script {
+	return redis.NewScript(2, scriptPrelude+src)
+}
+
+// run runs the store script with arguments of the operation.
+func (rs *redisStore) run(script *redis.Script, args ...interface{}) (interface{}, error) {
+	conn := rs.memory.pool.Get()
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	ttl := int64(rs.memory.ttl / time.Millisecond)
+	keysAndArgs := append([]interface{}{rs.key, rs.key + ttlSuffix, now, ttl}, args...)
+	reply, err := script.Do(conn, keysAndArgs...)
+	if _, ok := err.(redis.Error); !ok && err != nil && err != redis.ErrNil {
+		log.WithFields(log.Fields{"command": "EVALSHA", "error": err}).Error("Redis command failed")
+	}
+	return reply, err
+}
+
+func (rs *redisStore) Set(key string, value string) {
+	rs.run(setScript, key, value, 0)
+}
+
+func (rs *redisStore) SetWithTTL(key string, value string, ttl time.Duration) {
+	rs.run(setScript, key, value, int64(ttl/time.Millisecond))
+}
+
+func (rs *redisStore) Get(key string) string {
+	value, _ := rs.Lookup(key)
+	return value
+}
+
+func (rs *redisStore) Delete(key string) {
+	conn := rs.memory.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", rs.key, key)
+	conn.Send("HDEL", rs.key+ttlSuffix, key)
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.WithFields(log.Fields{"command": "HDEL", "error": err}).Error("Redis command failed")
+	}
+}
+
+func (rs *redisStore) Lookup(key string) (string, bool) {
+	value, err := redis.String(rs.run(getScript, key))
+	return value, err == nil
+}
+
+func (rs *redisStore) Keys() []string {
+	keys, _ := redis.Strings(rs.run(keysScript))
+	return keys
+}
+
+func (rs *redisStore) SetMany(values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	rs.run(setManyScript, redis.Args{}.AddFlat(values)...)
+}
+
+func (rs *redisStore) Incr(key string, delta int64) (int64, error) {
+	return redis.Int64(rs.run(incrScript, key, delta))
+}
+
+func (rs *redisStore) CompareAndSwap(key string, old string, new string) bool {
+	swapped, _ := redis.Bool(rs.run(casScript, key, old, new))
+	return swapped
+}
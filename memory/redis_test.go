@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedis returns a memory backed by an in-process Redis server, and a function closing both.
+func newTestRedis(t *testing.T, config RedisConfig) (*miniredis.Miniredis, Memory, func()) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Address = server.Addr()
+	m := NewRedisMemory(config)
+	return server, m, func() {
+		m.(*redisMemory).Close()
+		server.Close()
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	_, m, closeRedis := newTestRedis(t, RedisConfig{Prefix: "test:"})
+	defer closeRedis()
+	testStore(t, m)
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	_, m, closeRedis := newTestRedis(t, RedisConfig{})
+	defer closeRedis()
+	testStoreTTL(t, m)
+}
+
+func TestRedisUsersSkipsTTLHashes(t *testing.T) {
+	server, m, closeRedis := newTestRedis(t, RedisConfig{Prefix: "p:"})
+	defer closeRedis()
+	m.For("u").SetWithTTL("k", "v", time.Hour)
+	if !server.Exists("p:u" + ttlSuffix) {
+		t.Fatal("TTL hash is not written")
+	}
+	if ids := m.Users(); len(ids) != 1 || ids[0] != "u" {
+		t.Errorf("Users() = %v, want [u]", ids)
+	}
+}
+
+func TestRedisMemoryTTL(t *testing.T) {
+	server, m, closeRedis := newTestRedis(t, RedisConfig{TTL: time.Minute})
+	defer closeRedis()
+	m.For("u").Set("k", "v")
+	server.FastForward(2 * time.Minute)
+	if v := m.For("u").Get("k"); v != "" {
+		t.Errorf("Get() = %q after the TTL of the user's data", v)
+	}
+}
+
+func TestRedisCompareAndSwapIsAtomic(t *testing.T) {
+	_, m, closeRedis := newTestRedis(t, RedisConfig{})
+	defer closeRedis()
+	s := m.For("u")
+	s.Set("n", "0")
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			swapped := false
+			for !swapped {
+				v := s.Get("n")
+				n := len(v)
+				swapped = s.CompareAndSwap("n", v, v+string(rune('a'+n%26)))
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if v := s.Get("n"); len(v) != 11 {
+		t.Errorf("value %q has %d swaps, want 10", v, len(v)-1)
+	}
+}
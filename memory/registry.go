@@ -0,0 +1,121 @@
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Factory creates a memory from its configuration.
+type Factory func(config map[string]string) (Memory, error)
+
+var factoriesMutex sync.RWMutex
+var factories map[string]Factory = make(map[string]Factory)
+
+func init() {
+	Register("ephemeral", openEphemeralMemory)
+	Register("redis", openRedisMemory)
+	Register("bolt", openBoltMemory)
+}
+
+// Register makes a memory type available by name to Open.
+// Registering a name twice replaces the previous factory.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	factories[name] = factory
+}
+
+// Open opens a memory of the registered type name.
+// Built-in types and their configuration keys are:
+//
+//	ephemeral: keeps data in RAM, max_users, max_keys, snapshot
+//	redis: address, password, db, prefix, ttl, max_idle, max_active, idle_timeout
+//	bolt: path (required)
+//
+// Durations are written like "10m" or "24h".
+func Open(name string, config map[string]string) (Memory, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[name]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMemoryType, name)
+	}
+	if config == nil {
+		config = make(map[string]string)
+	}
+	return factory(config)
+}
+
+func openEphemeralMemory(config map[string]string) (Memory, error) {
+	var c EphemeralConfig
+	var err error
+	c.SnapshotPath = config["snapshot"]
+	if c.MaxUsers, err = configInt(config, "max_users"); err != nil {
+		return nil, err
+	}
+	maxKeys, err := configInt(config, "max_keys")
+	if err != nil {
+		return nil, err
+	}
+	c.MaxKeys = int64(maxKeys)
+	return NewEphemeralMemory(c)
+}
+
+func openRedisMemory(config map[string]string) (Memory, error) {
+	var c RedisConfig
+	var err error
+	c.Address = config["address"]
+	c.Password = config["password"]
+	c.Prefix = config["prefix"]
+	if c.DB, err = configInt(config, "db"); err != nil {
+		return nil, err
+	}
+	if c.MaxIdle, err = configInt(config, "max_idle"); err != nil {
+		return nil, err
+	}
+	if c.MaxActive, err = configInt(config, "max_active"); err != nil {
+		return nil, err
+	}
+	if c.TTL, err = configDuration(config, "ttl"); err != nil {
+		return nil, err
+	}
+	if c.IdleTimeout, err = configDuration(config, "idle_timeout"); err != nil {
+		return nil, err
+	}
+	return NewRedisMemory(c), nil
+}
+
+func openBoltMemory(config map[string]string) (Memory, error) {
+	path := config["path"]
+	if path == "" {
+		return nil, fmt.Errorf("bolt memory: path is required")
+	}
+	return NewBoltMemory(path)
+}
+
+func configInt(config map[string]string, key string) (int, error) {
+	value, ok := config[key]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
+}
+
+func configDuration(config map[string]string, key string) (time.Duration, error) {
+	value, ok := config[key]
+	if !ok || value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenUnknownType(t *testing.T) {
+	m, err := Open("nosuchmemory", nil)
+	if m != nil || !errors.Is(err, ErrMemoryType) {
+		t.Errorf("Open(unknown) = %v, %v, want ErrMemoryType", m, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("New(unknown) did not panic")
+		}
+	}()
+	New("nosuchmemory")
+}
+
+func TestRegisterTwiceReplaces(t *testing.T) {
+	first, second := NewNamespace(New("ephemeral"), "first"), NewNamespace(New("ephemeral"), "second")
+	Register("test-twice", func(map[string]string) (Memory, error) { return first, nil })
+	Register("test-twice", func(map[string]string) (Memory, error) { return second, nil })
+	defer func() {
+		factoriesMutex.Lock()
+		delete(factories, "test-twice")
+		factoriesMutex.Unlock()
+	}()
+
+	m, err := Open("test-twice", nil)
+	if err != nil || m != second {
+		t.Errorf("Open() = %v, %v, want the memory of the last registered factory", m, err)
+	}
+}
+
+func TestOpenConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		config  map[string]string
+		wantErr bool
+	}{
+		{"ephemeral", nil, false},
+		{"ephemeral", map[string]string{"max_users": "10", "max_keys": "100"}, false},
+		{"ephemeral", map[string]string{"max_users": "ten"}, true},
+		{"redis", map[string]string{"ttl": "24h", "db": "1"}, false},
+		{"redis", map[string]string{"ttl": "a day"}, true},
+		{"bolt", nil, true},
+		{"bolt", map[string]string{"path": filepath.Join(dir, "memory.db")}, false},
+	}
+	for _, tt := range tests {
+		m, err := Open(tt.name, tt.config)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Open(%s, %v) error = %v, want error %v", tt.name, tt.config, err, tt.wantErr)
+		}
+		if c, ok := m.(interface{ Close() error }); ok {
+			c.Close()
+		}
+	}
+}
@@ -24,7 +24,10 @@ func Use(adapter string, config map[string]string) error {
 	return usedAdapter.Init(config)
 }
 
-// Return detected intent and entities
+// Return detected intent and entities, nothing if no adapter is used
 func Detect(msg string) (intent string, entities map[string][]string) {
+	if usedAdapter == nil {
+		return intent, entities
+	}
 	return usedAdapter.Detect(msg)
 }
@@ -285,10 +285,10 @@ type QuickRepliesMessage struct {
 }
 
 type QuickRepliesItem struct {
-	ContentType string `json:"content_type"`        // 'text' or 'location'
-	Title       string `json:"title,omitempty"`     // empty when ContentType='location'
-	Payload     string `json:"payload,omitempty"`   // empty when ContentType='location'
-	ImageURL    string `json:"image_url,omitempty"` // optional, empty when ContentType='location'
+	ContentType string `json:"content_type"`        // 'text', 'location', 'user_phone_number' or 'user_email'
+	Title       string `json:"title,omitempty"`     // empty when ContentType is not 'text'
+	Payload     string `json:"payload,omitempty"`   // empty when ContentType is not 'text'
+	ImageURL    string `json:"image_url,omitempty"` // optional, empty when ContentType is not 'text'
 }
 
 func NewQuickRepliesText(title string, payload string) QuickRepliesItem {
@@ -304,3 +304,17 @@ func NewQuickRepliesLocation() QuickRepliesItem {
 		ContentType: "location",
 	}
 }
+
+// NewQuickRepliesPhoneNumber asks for the user's phone number, which is sent back as the payload
+func NewQuickRepliesPhoneNumber() QuickRepliesItem {
+	return QuickRepliesItem{
+		ContentType: "user_phone_number",
+	}
+}
+
+// NewQuickRepliesEmail asks for the user's email, which is sent back as the payload
+func NewQuickRepliesEmail() QuickRepliesItem {
+	return QuickRepliesItem{
+		ContentType: "user_email",
+	}
+}
@@ -1,5 +1,107 @@
 package fbbot
 
+// pageNamespace prefixes the namespace of memories of a page bot.
+const pageNamespace = "fbbot.page."
+
 type Page struct {
 	ID string `json:"id"`
 }
+
+// AddPage registers a page served by the bot's webhook and returns the bot of the page.
+// Events of the page are routed to handlers added to the returned bot,
+// and replies sent through it use the page's access token.
+// The page bot's LTMemory and STMemory are namespaces of the bot's ones,
+// so pages share the configured backend but not data. Set the bot's memories before adding pages;
+// the page bot's memories can be replaced.
+// Adding a page that is already registered replaces it.
+// Use SetTokenProvider on the page bot to rotate its token.
+//
+// Page bots are served by the bot that created them, do not call Run on them.
+func (b *Bot) AddPage(id string, pageAccessToken string) *Bot {
+	p := &Bot{
+		Page:      Page{ID: id},
+		appSecret: b.appSecret,
+		tokens:    StaticToken(pageAccessToken),
+		Logger:    b.Logger,
+		redactor:  b.redactor,
+	}
+	p.LTMemory = b.LTMemory.Namespace(pageNamespace + id)
+	p.STMemory = b.STMemory.Namespace(pageNamespace + id)
+	p.Profiles = NewProfileService(p)
+
+	b.pagesMutex.Lock()
+	defer b.pagesMutex.Unlock()
+	if b.pages == nil {
+		b.pages = make(map[string]*Bot)
+	}
+	b.pages[id] = p
+	return p
+}
+
+// RemovePage stops routing events of the page. Events of a removed page
+// are handled by the bot itself, like events of any unregistered page.
+func (b *Bot) RemovePage(id string) {
+	b.pagesMutex.Lock()
+	defer b.pagesMutex.Unlock()
+
+	delete(b.pages, id)
+	for account, page := range b.instagram {
+		if page == id {
+			delete(b.instagram, account)
+		}
+	}
+}
+
+// AddInstagramAccount routes events of the Instagram professional account linked to the page
+// to the bot of the page, or to the bot itself if pageID is its own page.
+// Webhook entries of Instagram carry the ID of the account instead of the page.
+func (b *Bot) AddInstagramAccount(instagramID string, pageID string) {
+	b.pagesMutex.Lock()
+	defer b.pagesMutex.Unlock()
+	if b.instagram == nil {
+		b.instagram = make(map[string]string)
+	}
+	b.instagram[instagramID] = pageID
+}
+
+// PageBot returns the bot of a page registered by AddPage.
+func (b *Bot) PageBot(id string) (*Bot, bool) {
+	b.pagesMutex.RLock()
+	defer b.pagesMutex.RUnlock()
+
+	p, ok := b.pages[id]
+	return p, ok
+}
+
+// Pages returns IDs of all registered pages.
+func (b *Bot) Pages() []string {
+	b.pagesMutex.RLock()
+	defer b.pagesMutex.RUnlock()
+
+	ids := make([]string, 0, len(b.pages))
+	for id := range b.pages {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// routeEntry returns the bot handling a webhook entry of the page or Instagram account id.
+func (b *Bot) routeEntry(id string, platform Platform) *Bot {
+	if platform == PlatformInstagram {
+		b.pagesMutex.RLock()
+		pageID, ok := b.instagram[id]
+		b.pagesMutex.RUnlock()
+		if ok {
+			id = pageID
+		}
+	}
+	return b.route(id)
+}
+
+// route returns the bot handling events of the page.
+func (b *Bot) route(pageID string) *Bot {
+	if p, ok := b.PageBot(pageID); ok {
+		return p
+	}
+	return b
+}
@@ -0,0 +1,62 @@
+package fbbot
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/michlabs/fbbot/memory"
+)
+
+func TestAddPageSharesMemoryBackend(t *testing.T) {
+	b := New(0, "verify", "secret", "token")
+	lt := memory.New("ephemeral")
+	b.LTMemory = lt
+
+	p1 := b.AddPage("p1", "t1")
+	p2 := b.AddPage("p2", "t2")
+	p1.LTMemory.For("u").Set("k", "one")
+	p2.LTMemory.For("u").Set("k", "two")
+
+	if v := p1.LTMemory.For("u").Get("k"); v != "one" {
+		t.Errorf("page p1 reads %q, want %q", v, "one")
+	}
+	if v := b.LTMemory.For("u").Get("k"); v != "" {
+		t.Errorf("root bot reads %q of a page, want nothing", v)
+	}
+	if keys := lt.For("u").Keys(); len(keys) != 2 {
+		t.Errorf("backend has keys %v, want the keys of both pages", keys)
+	}
+}
+
+func TestAddPageSignsWithAppSecret(t *testing.T) {
+	b := New(0, "verify", "secret", "token")
+	p := b.AddPage("p1", "t1")
+
+	req, err := p.newRequest(context.Background(), "GET", APIEndpoint+"/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer t1" {
+		t.Errorf("Authorization = %q, want the token of the page", auth)
+	}
+	if proof, want := req.URL.Query().Get("appsecret_proof"), sign(sha256.New, "", "secret", "t1"); proof != want {
+		t.Errorf("appsecret_proof = %q, want %q", proof, want)
+	}
+
+	body := `{"object":"page","entry":[]}`
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", body))
+	if !b.verifySignature([]byte(body), header) {
+		t.Error("signature made with the app secret is rejected")
+	}
+	header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "token", body))
+	if b.verifySignature([]byte(body), header) {
+		t.Error("signature made with the page access token is accepted")
+	}
+	if strings.Contains(req.URL.String(), "t1") {
+		t.Errorf("request URL %s contains the page access token", req.URL)
+	}
+}
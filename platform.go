@@ -0,0 +1,38 @@
+package fbbot
+
+import (
+	"errors"
+)
+
+// Platform is the messaging platform a message was received from.
+type Platform string
+
+const (
+	PlatformMessenger Platform = "messenger"
+	PlatformInstagram Platform = "instagram"
+)
+
+// ErrNotSupported is returned when sending a message type that the recipient's platform does not support.
+var ErrNotSupported error = errors.New("message type is not supported on the platform")
+
+// platformOf returns the platform of a callback message by its object type.
+func platformOf(object string) Platform {
+	if object == "instagram" {
+		return PlatformInstagram
+	}
+	return PlatformMessenger
+}
+
+// supports reports whether message m can be sent on the platform.
+// Instagram only supports text, image, generic template and quick replies.
+func (p Platform) supports(m interface{}) bool {
+	if p != PlatformInstagram {
+		return true
+	}
+	switch m.(type) {
+	case *TextMessage, *ImageMessage, *GenericMessage, *QuickRepliesMessage:
+		return true
+	default:
+		return false
+	}
+}
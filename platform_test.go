@@ -0,0 +1,144 @@
+package fbbot
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// messageRecorder is a message handler passing messages to a channel.
+type messageRecorder chan *Message
+
+func (r messageRecorder) HandleMessage(bot *Bot, msg *Message) { r <- msg }
+
+const instagramCallback = `{
+	"object": "instagram",
+	"entry": [{
+		"id": "ig1",
+		"time": 1700000000000,
+		"messaging": [
+			{"sender": {"id": "u1"}, "recipient": {"id": "ig1"}, "timestamp": 1700000000000,
+			 "message": {"mid": "m1", "text": "hello"}},
+			{"sender": {"id": "u1"}, "recipient": {"id": "ig1"}, "timestamp": 1700000000001,
+			 "postback": {"payload": "BUY"}}
+		]
+	}]
+}`
+
+func TestPlatformOf(t *testing.T) {
+	tests := []struct {
+		object string
+		want   Platform
+	}{
+		{"page", PlatformMessenger},
+		{"instagram", PlatformInstagram},
+		{"", PlatformMessenger},
+	}
+	for _, tt := range tests {
+		if got := platformOf(tt.object); got != tt.want {
+			t.Errorf("platformOf(%q) = %q, want %q", tt.object, got, tt.want)
+		}
+	}
+}
+
+func TestUnboxInstagram(t *testing.T) {
+	b := newTestBot()
+	var callback rawCallbackMessage
+	if err := json.Unmarshal([]byte(instagramCallback), &callback); err != nil {
+		t.Fatal(err)
+	}
+	messages := callback.RawEntries[0].Unbox(b, platformOf(callback.RawObject))
+	if len(messages) != 2 {
+		t.Fatalf("Unbox() = %d messages, want 2", len(messages))
+	}
+
+	msg, ok := messages[0].(*Message)
+	if !ok {
+		t.Fatalf("first message = %T, want *Message", messages[0])
+	}
+	if msg.Text != "hello" || msg.Platform != PlatformInstagram || msg.Sender.Platform() != PlatformInstagram {
+		t.Errorf("message = %+v, want text hello from Instagram", msg)
+	}
+	pbk, ok := messages[1].(*Postback)
+	if !ok {
+		t.Fatalf("second message = %T, want *Postback", messages[1])
+	}
+	if pbk.Payload != "BUY" || pbk.Platform != PlatformInstagram || pbk.Sender.Platform() != PlatformInstagram {
+		t.Errorf("postback = %+v, want payload BUY from Instagram", pbk)
+	}
+}
+
+func TestRouteInstagramEntries(t *testing.T) {
+	b := newTestBot()
+	p := b.AddPage("page1", "page-token")
+	b.AddInstagramAccount("ig1", "page1")
+
+	tests := []struct {
+		name     string
+		id       string
+		platform Platform
+		want     *Bot
+	}{
+		{"linked account", "ig1", PlatformInstagram, p},
+		{"page", "page1", PlatformMessenger, p},
+		{"account id on Messenger", "ig1", PlatformMessenger, b},
+		{"unknown account", "ig2", PlatformInstagram, b},
+	}
+	for _, tt := range tests {
+		if got := b.routeEntry(tt.id, tt.platform); got != tt.want {
+			t.Errorf("%s: routeEntry(%q) = %p, want %p", tt.name, tt.id, got, tt.want)
+		}
+	}
+
+	b.RemovePage("page1")
+	if got := b.routeEntry("ig1", PlatformInstagram); got != b {
+		t.Errorf("routeEntry() after RemovePage = %p, want the bot", got)
+	}
+}
+
+func TestHandleInstagramCallback(t *testing.T) {
+	b := newTestBot()
+	p := b.AddPage("page1", "page-token")
+	b.AddInstagramAccount("ig1", "page1")
+	received := make(messageRecorder, 1)
+	p.AddMessageHandler(received)
+
+	r := httptest.NewRequest("POST", WebhookURL, strings.NewReader(instagramCallback))
+	r.Header.Set("X-Hub-Signature-256", sign(sha256.New, "sha256=", "secret", instagramCallback))
+	w := httptest.NewRecorder()
+	b.handle(w, r)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	select {
+	case msg := <-received:
+		if msg.Platform != PlatformInstagram || msg.Text != "hello" {
+			t.Errorf("page bot received %+v, want the Instagram message", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("the Instagram message did not reach the bot of the linked page")
+	}
+}
+
+func TestSendToInstagramUser(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	b := newTestBot()
+	u := b.User("u1").WithPlatform(PlatformInstagram)
+	if u.Platform() != PlatformInstagram {
+		t.Fatalf("Platform() = %q, want instagram", u.Platform())
+	}
+	if err := b.Send(u, &ButtonMessage{}); err != ErrNotSupported {
+		t.Errorf("Send(button) to an Instagram user = %v, want ErrNotSupported", err)
+	}
+	if err := b.SendText(u, "hi"); err != nil {
+		t.Fatalf("SendText() = %v", err)
+	}
+	if sent := transport.sent(); len(sent) != 1 || !strings.Contains(sent[0], `"id":"u1"`) {
+		t.Errorf("sent %q, want a text to u1", sent)
+	}
+}
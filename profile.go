@@ -0,0 +1,198 @@
+package fbbot
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/michlabs/fbbot/memory"
+)
+
+// DefaultProfileTTL is how long a fetched profile is considered fresh.
+const DefaultProfileTTL = 24 * time.Hour
+
+// DefaultProfileFetchTimeout is how long a fetch of a profile may take if ProfileService.FetchTimeout is zero.
+const DefaultProfileFetchTimeout = 10 * time.Second
+
+// profileMemoryKey is the key a profile is saved under in the user's Store.
+const profileMemoryKey = "fbbot.profile"
+
+// Profile is public profile information of an user.
+type Profile struct {
+	FirstName        string  `json:"first_name,omitempty"`
+	LastName         string  `json:"last_name,omitempty"`
+	ProfilePic       string  `json:"profile_pic,omitempty"`
+	Locale           string  `json:"locale,omitempty"`
+	Timezone         float32 `json:"timezone,omitempty"`
+	Gender           string  `json:"gender,omitempty"`
+	IsPaymentEnabled bool    `json:"is_payment_enabled,omitempty"` // Is the user eligible to receive messenger platform payment messages
+}
+
+// FullName returns first name and last name of the user.
+func (p Profile) FullName() string {
+	return p.FirstName + " " + p.LastName
+}
+
+type cachedProfile struct {
+	Profile   Profile   `json:"profile"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// profileCall is an in-flight fetch, shared by all callers asking for the same user.
+type profileCall struct {
+	done    chan struct{}
+	profile Profile
+	err     error
+}
+
+// ProfileService fetches user profiles from the Graph API and caches them.
+// Concurrent requests for the same user are deduplicated into one API call.
+// It is safe for concurrent use.
+type ProfileService struct {
+	// TTL is how long a fetched profile is used before it is fetched again.
+	TTL time.Duration
+
+	// FetchTimeout limits how long a fetch from the Graph API may take, DefaultProfileFetchTimeout if zero.
+	FetchTimeout time.Duration
+
+	// Memory, if set, persists fetched profiles, e.g. in Bot.LTMemory,
+	// so they survive restarts. Nil means profiles are only cached in process.
+	Memory memory.Memory
+
+	fetch func(context.Context, string) (Profile, error)
+
+	mutex     sync.Mutex // guards cache, calls and lastSweep, never held during I/O
+	cache     map[string]cachedProfile
+	calls     map[string]*profileCall
+	lastSweep time.Time
+}
+
+// NewProfileService returns a ProfileService fetching profiles through the bot.
+func NewProfileService(b *Bot) *ProfileService {
+	return &ProfileService{
+		TTL:       DefaultProfileTTL,
+		fetch:     b.fetchProfile,
+		cache:     make(map[string]cachedProfile),
+		calls:     make(map[string]*profileCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns profile of the user, from cache if it is still fresh.
+func (s *ProfileService) Get(ctx context.Context, userID string) (Profile, error) {
+	if c, ok := s.lookup(userID); ok {
+		return c.Profile, nil
+	}
+
+	s.mutex.Lock()
+	if call, ok := s.calls[userID]; ok {
+		s.mutex.Unlock()
+		return s.wait(ctx, call)
+	}
+	call := &profileCall{done: make(chan struct{})}
+	s.calls[userID] = call
+	s.mutex.Unlock()
+
+	go s.do(userID, call)
+	return s.wait(ctx, call)
+}
+
+// Invalidate drops the cached profile of the user, so it is fetched again on next Get.
+func (s *ProfileService) Invalidate(userID string) {
+	s.mutex.Lock()
+	delete(s.cache, userID)
+	s.mutex.Unlock()
+
+	if s.Memory != nil {
+		s.Memory.For(userID).Delete(profileMemoryKey)
+	}
+}
+
+// do fetches the profile and wakes up everyone waiting for it.
+// The fetch is not bound to a caller's context, since other callers may share it,
+// but to its own deadline, so a hung request does not block later callers forever.
+func (s *ProfileService) do(userID string, call *profileCall) {
+	timeout := s.FetchTimeout
+	if timeout <= 0 {
+		timeout = DefaultProfileFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	call.profile, call.err = s.fetch(ctx, userID)
+	cancel()
+
+	if call.err == nil {
+		s.store(userID, cachedProfile{Profile: call.profile, FetchedAt: time.Now()})
+	}
+
+	s.mutex.Lock()
+	delete(s.calls, userID)
+	s.mutex.Unlock()
+
+	close(call.done)
+}
+
+func (s *ProfileService) wait(ctx context.Context, call *profileCall) (Profile, error) {
+	select {
+	case <-call.done:
+		return call.profile, call.err
+	case <-ctx.Done():
+		return Profile{}, ctx.Err()
+	}
+}
+
+// lookup returns the cached profile of the user if it is fresh,
+// reading Memory outside of the mutex on a cache miss.
+func (s *ProfileService) lookup(userID string) (cachedProfile, bool) {
+	s.mutex.Lock()
+	c, ok := s.cache[userID]
+	if ok && !s.fresh(c) {
+		delete(s.cache, userID)
+		ok = false
+	}
+	s.mutex.Unlock()
+	if ok || s.Memory == nil {
+		return c, ok
+	}
+
+	data := s.Memory.For(userID).Get(profileMemoryKey)
+	if data == "" || json.Unmarshal([]byte(data), &c) != nil || !s.fresh(c) {
+		return c, false
+	}
+	s.mutex.Lock()
+	s.cache[userID] = c
+	s.mutex.Unlock()
+	return c, true
+}
+
+// store caches the profile and writes it to Memory outside of the mutex.
+func (s *ProfileService) store(userID string, c cachedProfile) {
+	s.mutex.Lock()
+	s.cache[userID] = c
+	s.sweep()
+	s.mutex.Unlock()
+
+	if s.Memory != nil {
+		if data, err := json.Marshal(c); err == nil {
+			s.Memory.For(userID).Set(profileMemoryKey, string(data))
+		}
+	}
+}
+
+// sweep drops expired profiles from the cache, at most once per TTL.
+// It must be called with the mutex held.
+func (s *ProfileService) sweep() {
+	if time.Since(s.lastSweep) < s.TTL {
+		return
+	}
+	for id, c := range s.cache {
+		if !s.fresh(c) {
+			delete(s.cache, id)
+		}
+	}
+	s.lastSweep = time.Now()
+}
+
+func (s *ProfileService) fresh(c cachedProfile) bool {
+	return time.Since(c.FetchedAt) <= s.TTL
+}
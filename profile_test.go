@@ -0,0 +1,75 @@
+package fbbot
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProfileServiceFetchTimeout(t *testing.T) {
+	s := &ProfileService{
+		TTL:          time.Hour,
+		FetchTimeout: 20 * time.Millisecond,
+		cache:        make(map[string]cachedProfile),
+		calls:        make(map[string]*profileCall),
+	}
+	s.fetch = func(ctx context.Context, id string) (Profile, error) {
+		<-ctx.Done() // a hung Graph API call
+		return Profile{}, ctx.Err()
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Get(context.Background(), "u")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Get() error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get() blocked on a hung fetch")
+	}
+
+	s.mutex.Lock()
+	n := len(s.calls)
+	s.mutex.Unlock()
+	if n != 0 {
+		t.Errorf("%d calls left in flight", n)
+	}
+}
+
+func TestProfileServiceCacheAndSweep(t *testing.T) {
+	var fetches int32
+	s := &ProfileService{
+		TTL:   time.Hour,
+		cache: make(map[string]cachedProfile),
+		calls: make(map[string]*profileCall),
+	}
+	s.fetch = func(ctx context.Context, id string) (Profile, error) {
+		atomic.AddInt32(&fetches, 1)
+		return Profile{FirstName: id}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		p, err := s.Get(context.Background(), "alice")
+		if err != nil || p.FirstName != "alice" {
+			t.Fatalf("Get() = %v, %v", p, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times, want 1", fetches)
+	}
+
+	s.cache["stale"] = cachedProfile{FetchedAt: time.Now().Add(-2 * time.Hour)}
+	s.lastSweep = time.Now().Add(-2 * time.Hour)
+	if _, err := s.Get(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.cache["stale"]; ok {
+		t.Error("expired profile is not evicted")
+	}
+}
@@ -7,23 +7,26 @@ import (
 // rawCallbackMessage is data you will receive at your webhook
 type rawCallbackMessage struct {
 	// Object indicates the object type that this payload applies to.
-	// It could be: user, page, permissions, payments.
-	// In this case, value will alway be "page".
+	// It could be: user, page, permissions, payments, instagram.
+	// In this case, value will be "page" or "instagram".
 	RawObject string `json:"object"`
 
 	// rawEntries is a slice containing event data of the same object type
 	// that are batched together
-	RawEntries []struct {
-		// rawID is ID of the object that triggers this event.
-		// In this case, it will alway be Page ID
-		RawID string `json:"id"`
+	RawEntries []rawEntry `json:"entry"`
+}
+
+// rawEntry is event data of a single page
+type rawEntry struct {
+	// rawID is ID of the object that triggers this event.
+	// In this case, it will be Page ID, or Instagram account ID for instagram objects
+	RawID string `json:"id"`
 
-		// rawEventTime is time the event data was sent
-		RawEventTime int64 `json:"time"`
+	// rawEventTime is time the event data was sent
+	RawEventTime int64 `json:"time"`
 
-		// rawMessaging contains data related to messaging
-		RawMessaging []rawMessageData `json:"messaging"`
-	} `json:"entry"`
+	// rawMessaging contains data related to messaging
+	RawMessaging []rawMessageData `json:"messaging"`
 }
 
 // rawMessageData contains data related to a message
@@ -42,6 +45,7 @@ type rawMessageData struct {
 	Postback       *Postback       `json:"postback"`
 	Delivery       *Delivery       `json:"delivery"`
 	Optin          *Optin          `json:"optin"`
+	Referral       *Referral       `json:"referral"`
 	Read           *Read           `json:"read"`
 	CheckoutUpdate *CheckoutUpdate `json:"checkout_update"`
 	Payment        *Payment        `json:"payment"`
@@ -67,12 +71,24 @@ type rawMessage struct {
 
 	// rawAttachments is a slice containing attachment data
 	RawAttachments []rawAttachment `json:"attachments"`
+
+	// rawReplyTo is set when the message replies to an Instagram story
+	RawReplyTo *rawReplyTo `json:"reply_to"`
+}
+
+type rawReplyTo struct {
+	RawStory *rawStory `json:"story"`
+}
+
+type rawStory struct {
+	RawID  string `json:"id"`
+	RawURL string `json:"url"`
 }
 
 // rawAttachment is attached image, video, audio or location
 type rawAttachment struct {
 	// rawType is type of the attachment
-	// It could be: image, video, audio or location
+	// It could be: image, video, audio, file, location or story_mention
 	RawType string `json:"type"`
 
 	// Attachment file
@@ -96,32 +112,43 @@ type rawQuickreply struct {
 	Payload string `json:"payload"`
 }
 
-func (cbMsg *rawCallbackMessage) Unbox() []interface{} {
+// Unbox converts the entry into messages received from the platform,
+// whose senders are bound to the bot b.
+func (entry *rawEntry) Unbox(b *Bot, platform Platform) []interface{} {
 	var messages []interface{}
-	for _, entry := range cbMsg.RawEntries {
-		for _, rawMessageData := range entry.RawMessaging {
-			if rawMessageData.RawMessage != nil {
-				messages = append(messages, buildMessage(rawMessageData))
-			} else if rawMessageData.Postback != nil {
-				rawMessageData.Postback.Sender = rawMessageData.RawSender
-				messages = append(messages, rawMessageData.Postback)
-			} else if rawMessageData.Delivery != nil {
-				messages = append(messages, rawMessageData.Delivery)
-			} else if rawMessageData.Optin != nil {
-				rawMessageData.Optin.Sender = rawMessageData.RawSender
-				messages = append(messages, rawMessageData.Optin)
-			} else if rawMessageData.Read != nil {
-				rawMessageData.Read.Sender = rawMessageData.RawSender
-				messages = append(messages, rawMessageData.Read)
-			} else if rawMessageData.CheckoutUpdate != nil {
-				rawMessageData.CheckoutUpdate.Sender = rawMessageData.RawSender
-				messages = append(messages, rawMessageData.CheckoutUpdate)
-			} else if rawMessageData.Payment != nil {
-				rawMessageData.Payment.Sender = rawMessageData.RawSender
-				messages = append(messages, rawMessageData.Payment)
-			} else {
-				logrus.WithFields(logrus.Fields{"rawMessageData": rawMessageData}).Error("Unknown message type")
+	for _, rawMessageData := range entry.RawMessaging {
+		rawMessageData.RawSender.bot = b
+		rawMessageData.RawSender.platform = platform
+		if rawMessageData.RawMessage != nil {
+			msg := buildMessage(rawMessageData)
+			msg.Platform = platform
+			messages = append(messages, msg)
+		} else if rawMessageData.Postback != nil {
+			rawMessageData.Postback.Sender = rawMessageData.RawSender
+			rawMessageData.Postback.Platform = platform
+			if rawMessageData.Postback.Referral != nil {
+				rawMessageData.Postback.Referral.Sender = rawMessageData.RawSender
 			}
+			messages = append(messages, rawMessageData.Postback)
+		} else if rawMessageData.Delivery != nil {
+			messages = append(messages, rawMessageData.Delivery)
+		} else if rawMessageData.Optin != nil {
+			rawMessageData.Optin.Sender = rawMessageData.RawSender
+			messages = append(messages, rawMessageData.Optin)
+		} else if rawMessageData.Referral != nil {
+			rawMessageData.Referral.Sender = rawMessageData.RawSender
+			messages = append(messages, rawMessageData.Referral)
+		} else if rawMessageData.Read != nil {
+			rawMessageData.Read.Sender = rawMessageData.RawSender
+			messages = append(messages, rawMessageData.Read)
+		} else if rawMessageData.CheckoutUpdate != nil {
+			rawMessageData.CheckoutUpdate.Sender = rawMessageData.RawSender
+			messages = append(messages, rawMessageData.CheckoutUpdate)
+		} else if rawMessageData.Payment != nil {
+			rawMessageData.Payment.Sender = rawMessageData.RawSender
+			messages = append(messages, rawMessageData.Payment)
+		} else {
+			logrus.WithFields(logrus.Fields{"rawMessageData": rawMessageData}).Error("Unknown message type")
 		}
 	}
 	return messages
@@ -160,8 +187,17 @@ func buildMessage(m rawMessageData) *Message {
 				},
 			}
 			msg.Location = location
+		case "story_mention":
+			mention := StoryMention{URL: attachment.RawPayload.RawURL}
+			msg.StoryMentions = append(msg.StoryMentions, mention)
 		}
 
 	}
+	if m.RawMessage.RawReplyTo != nil && m.RawMessage.RawReplyTo.RawStory != nil {
+		msg.StoryReply = StoryReply{
+			ID:  m.RawMessage.RawReplyTo.RawStory.RawID,
+			URL: m.RawMessage.RawReplyTo.RawStory.RawURL,
+		}
+	}
 	return &msg
 }
@@ -0,0 +1,88 @@
+package fbbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// redactor is a logrus hook replacing secrets of the bot in log messages and fields.
+type redactor struct {
+	mutex   sync.RWMutex
+	secrets map[string]struct{}
+}
+
+func newRedactor() *redactor {
+	return &redactor{secrets: make(map[string]struct{})}
+}
+
+// RedactHook returns the hook that removes tokens and the app secret from logs.
+// It is added to the default Logger; add it to your own logger when replacing Logger.
+func (b *Bot) RedactHook() logrus.Hook {
+	return b.redactor
+}
+
+func (r *redactor) add(secrets ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets[secret] = struct{}{}
+		}
+	}
+}
+
+func (r *redactor) redact(s string) string {
+	for secret := range r.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+func (r *redactor) contains(s string) bool {
+	for secret := range r.secrets {
+		if strings.Contains(s, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *redactor) Fire(entry *logrus.Entry) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry.Message = r.redact(entry.Message)
+
+	// Data is shared with the entry the fields were added to, so copy before changing it
+	var data logrus.Fields
+	for k, v := range entry.Data {
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprintf("%+v", v)
+		}
+		if !r.contains(s) {
+			continue
+		}
+		if data == nil {
+			data = make(logrus.Fields, len(entry.Data))
+			for k, v := range entry.Data {
+				data[k] = v
+			}
+		}
+		data[k] = r.redact(s)
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package fbbot
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michlabs/fbbot/memory"
+	log "github.com/sirupsen/logrus"
+)
+
+// TimeoutEvent is emitted for a step whose timeout set by SetStepTimeout passes without a message of the user.
+const TimeoutEvent Event = "timeout"
+
+// MessagingWindow is how long after the last message of an user a page may send him messages.
+// Reminders are not sent outside of it.
+const MessagingWindow = 24 * time.Hour
+
+// DefaultMaxReminders is how many reminders an user gets in a conversation if Dialog.MaxReminders is zero.
+const DefaultMaxReminders = 3
+
+// dialogRemindersKey is the key of the number of reminders sent to the user in the dialog's memory.
+const dialogRemindersKey = "fbbot.reminders"
+
+// ScheduledJob is the next timeout or reminder of an user at a step.
+type ScheduledJob struct {
+	UserID   string    `json:"user"`
+	PageID   string    `json:"page"`
+	Platform Platform  `json:"platform"`
+	Step     string    `json:"step"`
+	Since    time.Time `json:"since"`   // time of the last message of the user
+	Entered  time.Time `json:"entered"` // time timers of the step started
+	Next     int       `json:"next"`    // index of the next reminder of the step, the timeout after the last one
+	At       time.Time `json:"at"`      // time the job is due
+}
+
+// Scheduler keeps the scheduled jobs of a dialog, one per user, so they survive restarts.
+// It must not be shared by dialogs.
+type Scheduler interface {
+	// Schedule replaces the job of the user.
+	Schedule(job ScheduledJob) error
+
+	// Cancel removes the job of the user.
+	Cancel(userID string) error
+
+	// Due removes and returns the jobs due at now. A job must be returned once, even to several processes.
+	Due(now time.Time) ([]ScheduledJob, error)
+}
+
+// MemoryScheduler keeps jobs in a memory, e.g. redis or bolt to persist them.
+// Every job is saved under a key of its own, which is deleted when the job is replaced, canceled or due,
+// and the key of the job of an user is saved under the user ID.
+type MemoryScheduler struct {
+	store memory.Store
+}
+
+// Key prefixes of MemoryScheduler
+const (
+	schedulerJobPrefix  = "job."
+	schedulerUserPrefix = "user."
+	schedulerSeqKey     = "seq"
+)
+
+// NewMemoryScheduler returns a scheduler keeping jobs in m, under the user ID "fbbot.scheduler".
+// Use a namespace of m for each dialog sharing it.
+func NewMemoryScheduler(m memory.Memory) *MemoryScheduler {
+	return &MemoryScheduler{store: m.For("fbbot.scheduler")}
+}
+
+func (s *MemoryScheduler) Schedule(job ScheduledJob) error {
+	seq, err := s.store.Incr(schedulerSeqKey, 1)
+	if err != nil {
+		return err
+	}
+	key := schedulerJobPrefix + strconv.FormatInt(seq, 10)
+	if err := memory.SetJSON(s.store, key, job); err != nil {
+		return err
+	}
+	for {
+		old := s.store.Get(schedulerUserPrefix + job.UserID)
+		if s.store.CompareAndSwap(schedulerUserPrefix+job.UserID, old, key) {
+			if old != "" {
+				s.store.Delete(old)
+			}
+			return nil
+		}
+	}
+}
+
+func (s *MemoryScheduler) Cancel(userID string) error {
+	if key := s.store.Get(schedulerUserPrefix + userID); key != "" {
+		s.store.Delete(schedulerUserPrefix + userID)
+		s.store.Delete(key)
+	}
+	return nil
+}
+
+func (s *MemoryScheduler) Due(now time.Time) ([]ScheduledJob, error) {
+	var jobs []ScheduledJob
+	for _, key := range s.store.Keys() {
+		if !strings.HasPrefix(key, schedulerJobPrefix) {
+			continue
+		}
+		data := s.store.Get(key)
+		if data == "" { // taken or deleted
+			continue
+		}
+		var job ScheduledJob
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			return jobs, err
+		}
+		if job.At.After(now) {
+			continue
+		}
+		// taking the job by swapping it, so other processes skip it, then deleting it
+		if s.store.CompareAndSwap(key, data, "") {
+			s.store.Delete(key)
+			if s.store.Get(schedulerUserPrefix+job.UserID) == key {
+				s.store.Delete(schedulerUserPrefix + job.UserID)
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// reminder is a text sent to an user who has not sent anything at a step for a duration.
+type reminder struct {
+	after time.Duration
+	text  string
+}
+
+// stepTimer is the timeout and reminders of a step.
+type stepTimer struct {
+	timeout   time.Duration
+	reminders []reminder // sorted by after
+}
+
+// SetScheduler replaces where step timeouts and reminders are kept, in process memory by default.
+func (d *Dialog) SetScheduler(s Scheduler) {
+	d.scheduler = s
+}
+
+// SetStepTimeout makes the step emit TimeoutEvent when the user has not sent anything at it for the duration.
+// Timeouts and reminders are fired by RunScheduler.
+func (d *Dialog) SetStepTimeout(step Step, timeout time.Duration) {
+	d.AddSteps(step)
+	d.stepTimer(step).timeout = timeout
+}
+
+// AddReminder sends text to the user when he has not sent anything at the step for the duration,
+// unless his last message is older than MessagingWindow or he has got MaxReminders reminders in the conversation.
+// Reminders due after the timeout of the step are not sent.
+func (d *Dialog) AddReminder(step Step, after time.Duration, text string) {
+	d.AddSteps(step)
+	t := d.stepTimer(step)
+	t.reminders = append(t.reminders, reminder{after: after, text: text})
+	sort.SliceStable(t.reminders, func(i, j int) bool { return t.reminders[i].after < t.reminders[j].after })
+}
+
+func (d *Dialog) stepTimer(step Step) *stepTimer {
+	t, ok := d.stepTimers[d.key(step)]
+	if !ok {
+		t = &stepTimer{}
+		d.stepTimers[d.key(step)] = t
+	}
+	return t
+}
+
+// RunScheduler fires the due timeouts and reminders every interval until stop is closed.
+// Run it in its own goroutine, with the bot serving the dialog.
+func (d *Dialog) RunScheduler(bot *Bot, interval time.Duration, stop <-chan struct{}) {
+	runScheduler(bot, func() *Dialog { return d }, interval, stop)
+}
+
+// RunScheduler fires the due timeouts and reminders of the latest dialog compiled from the file
+// every interval until stop is closed. Run it in its own goroutine, with the bot serving the dialog.
+func (f *DialogFile) RunScheduler(bot *Bot, interval time.Duration, stop <-chan struct{}) {
+	runScheduler(bot, f.Dialog, interval, stop)
+}
+
+// runScheduler fires the due jobs of the dialog returned by current every interval until stop is closed.
+func runScheduler(bot *Bot, current func() *Dialog, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			d := current()
+			jobs, err := d.scheduler.Due(now)
+			if err != nil {
+				log.Errorf("Failed to get scheduled dialog jobs: %v", err)
+			}
+			for _, job := range jobs {
+				d.fire(bot.route(job.PageID), job)
+			}
+		}
+	}
+}
+
+// schedule schedules the first timer of the current step of the user, whose last message is at since.
+func (d *Dialog) schedule(bot *Bot, user User, since time.Time) {
+	if len(d.stepTimers) == 0 {
+		return
+	}
+	step := d.getStep(user.ID)
+	if step == nil || step == d.endStep || d.stepTimers[d.key(step)] == nil {
+		d.cancelJob(user.ID)
+		return
+	}
+	d.scheduleJob(ScheduledJob{
+		UserID:   user.ID,
+		PageID:   bot.Page.ID,
+		Platform: user.Platform(),
+		Step:     d.key(step),
+		Since:    since,
+		Entered:  time.Now(),
+	})
+}
+
+// scheduleJob schedules the job at the time of its next timer, or cancels it if there is none.
+func (d *Dialog) scheduleJob(job ScheduledJob) {
+	t := d.stepTimers[job.Step]
+	if job.Next < len(t.reminders) && t.timeout > 0 && t.reminders[job.Next].after >= t.timeout {
+		job.Next = len(t.reminders)
+	}
+	switch {
+	case job.Next < len(t.reminders):
+		job.At = job.Entered.Add(t.reminders[job.Next].after)
+	case t.timeout > 0:
+		job.At = job.Entered.Add(t.timeout)
+	default:
+		d.cancelJob(job.UserID)
+		return
+	}
+	if err := d.scheduler.Schedule(job); err != nil {
+		log.Errorf("Failed to schedule dialog job of user %s: %v", job.UserID, err)
+	}
+}
+
+func (d *Dialog) cancelJob(userID string) {
+	if err := d.scheduler.Cancel(userID); err != nil {
+		log.Errorf("Failed to cancel dialog job of user %s: %v", userID, err)
+	}
+}
+
+// fire sends the due reminder or emits TimeoutEvent, if the user is still at the step of the job.
+func (d *Dialog) fire(bot *Bot, job ScheduledJob) {
+	unlock := d.locks.lock(job.UserID)
+	defer unlock()
+
+	step := d.getStep(job.UserID)
+	t := d.stepTimers[job.Step]
+	if step == nil || d.key(step) != job.Step || t == nil {
+		return
+	}
+	user := bot.User(job.UserID).WithPlatform(job.Platform)
+
+	if job.Next < len(t.reminders) {
+		d.remind(bot, user, job.Since, t.reminders[job.Next])
+		job.Next++
+		d.scheduleJob(job)
+		return
+	}
+
+	msg := &Message{Sender: user, Platform: job.Platform}
+	d.transition(bot, msg, step, TimeoutEvent)
+	if d.getStep(job.UserID) == step { // no transition of TimeoutEvent, timers of the step are over
+		d.cancelJob(job.UserID)
+		return
+	}
+	d.schedule(bot, user, job.Since)
+}
+
+// remind sends the reminder to the user, whose last message is at since, within the limits.
+func (d *Dialog) remind(bot *Bot, user User, since time.Time, r reminder) {
+	if time.Since(since) >= MessagingWindow {
+		return
+	}
+	max := d.MaxReminders
+	if max == 0 {
+		max = DefaultMaxReminders
+	}
+	if max > 0 {
+		n, err := d.Memory(bot).For(user.ID).Incr(dialogRemindersKey, 1)
+		if err != nil || n > int64(max) {
+			return
+		}
+	}
+	if err := bot.SendText(user, r.text); err != nil {
+		bot.Logger.Errorf("Failed to send reminder to user %s: %v", user.ID, err)
+	}
+}
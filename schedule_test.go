@@ -0,0 +1,193 @@
+package fbbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fireDue fires the jobs of the dialog due within an hour until none is left, returning how many were fired.
+func fireDue(t *testing.T, bot *Bot, d *Dialog) int {
+	n := 0
+	for {
+		jobs, err := d.scheduler.Due(time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) == 0 {
+			return n
+		}
+		for _, job := range jobs {
+			d.fire(bot, job)
+			n++
+		}
+		if n > 100 {
+			t.Fatal("jobs are fired endlessly")
+		}
+	}
+}
+
+// schedulerKeys returns the keys left in the memory of the scheduler, but its sequence.
+func schedulerKeys(d *Dialog) []string {
+	var keys []string
+	for _, key := range d.scheduler.(*MemoryScheduler).store.Keys() {
+		if key != schedulerSeqKey {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestDialogUnhandledTimeoutIsNotRearmed(t *testing.T) {
+	bot := newTestBot()
+	wait, end := &namedStep{name: "wait"}, &namedStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(wait)
+	d.SetEndStep(end)
+	d.SetStepTimeout(wait, time.Minute)
+
+	d.HandleMessage(bot, testMessage("u1"))
+	if n := fireDue(t, bot, d); n != 1 {
+		t.Errorf("fired %d jobs, want the timeout once", n)
+	}
+	if got := d.getStep("u1"); got != wait {
+		t.Errorf("step after the timeout = %v, want the waiting step", got)
+	}
+	if keys := schedulerKeys(d); len(keys) != 0 {
+		t.Errorf("scheduler keys after the timeout = %q, want none", keys)
+	}
+}
+
+func TestDialogRemindersAreCapped(t *testing.T) {
+	transport := &recordingTransport{}
+	defer useTransport(transport)()
+
+	bot := newTestBot()
+	wait, end := &namedStep{name: "wait"}, &namedStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(wait)
+	d.SetEndStep(end)
+	for i := 1; i <= DefaultMaxReminders+2; i++ {
+		d.AddReminder(wait, time.Duration(i)*time.Minute, "Still there?")
+	}
+
+	d.HandleMessage(bot, testMessage("u1"))
+	if n := fireDue(t, bot, d); n != DefaultMaxReminders+2 {
+		t.Errorf("fired %d jobs, want every reminder", n)
+	}
+	if n := len(transport.sent()); n != DefaultMaxReminders {
+		t.Errorf("sent %d reminders, want DefaultMaxReminders %d", n, DefaultMaxReminders)
+	}
+	if keys := schedulerKeys(d); len(keys) != 0 {
+		t.Errorf("scheduler keys after the reminders = %q, want none", keys)
+	}
+}
+
+func TestMemorySchedulerRemovesJobs(t *testing.T) {
+	d := NewDialog()
+	s := d.scheduler
+	now := time.Now()
+	s.Schedule(ScheduledJob{UserID: "u1", At: now})
+	s.Schedule(ScheduledJob{UserID: "u1", At: now.Add(time.Second)}) // replaces the first job
+	s.Schedule(ScheduledJob{UserID: "u2", At: now})
+	s.Schedule(ScheduledJob{UserID: "u3", At: now})
+	s.Cancel("u3")
+
+	jobs, err := s.Due(now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("Due() = %d jobs, want the jobs of u1 and u2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.UserID == "u1" && !job.At.Equal(now.Add(time.Second)) {
+			t.Errorf("Due() returned the replaced job of u1")
+		}
+	}
+	if jobs, _ := s.Due(now.Add(time.Minute)); len(jobs) != 0 {
+		t.Errorf("Due() returned %d jobs twice", len(jobs))
+	}
+	if keys := schedulerKeys(d); len(keys) != 0 {
+		t.Errorf("scheduler keys after Due() = %q, want none", keys)
+	}
+}
+
+func TestDialogFileRunSchedulerFiresOnCurrentDialog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dialog.yaml")
+	definition := `
+begin: welcome
+end: bye
+steps:
+  - name: welcome
+    expect: text
+  - name: bye
+transitions:
+  - {from: [welcome], event: timeout, to: bye}
+`
+	if err := ioutil.WriteFile(path, []byte(definition), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewDialogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := newTestBot()
+	welcome, _ := f.Dialog().lookup("welcome")
+	f.Dialog().SetStepTimeout(welcome, 10*time.Millisecond)
+	f.HandleMessage(bot, testMessage("u1"))
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan string, 1)
+	f.Dialog().EnterHook = func(bot *Bot, c StepChange) { entered <- c.To.Name() }
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go f.RunScheduler(bot, 5*time.Millisecond, stop)
+	select {
+	case name := <-entered:
+		if name != "bye" {
+			t.Errorf("entered %q on timeout, want bye", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("the timeout was not fired on the reloaded dialog")
+	}
+}
+
+func TestDialogMoveSchedulesTimers(t *testing.T) {
+	bot := newTestBot()
+	begin, wait, end := &namedStep{name: "begin"}, &namedStep{name: "wait"}, &namedStep{name: "end"}
+	d := NewDialog()
+	d.SetBeginStep(begin)
+	d.SetEndStep(end)
+	d.SetStepTimeout(wait, time.Minute)
+
+	d.HandleMessage(bot, testMessage("u1"))
+	if keys := schedulerKeys(d); len(keys) != 0 {
+		t.Fatalf("scheduler keys at a step without timers = %q, want none", keys)
+	}
+	d.Move(bot, testMessage("u1"), wait)
+	jobs, _ := d.scheduler.Due(time.Now().Add(time.Hour))
+	if len(jobs) != 1 || jobs[0].Step != "wait" {
+		t.Errorf("jobs after Move = %+v, want the timeout of wait", jobs)
+	}
+
+	d.Move(bot, testMessage("u1"), wait)
+	d.Move(bot, testMessage("u1"), begin)
+	if keys := schedulerKeys(d); len(keys) != 0 {
+		t.Errorf("scheduler keys after Move to a step without timers = %q, want none", keys)
+	}
+}
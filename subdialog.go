@@ -0,0 +1,54 @@
+package fbbot
+
+// SubDialogStep runs another dialog as a sub-flow of the dialog it is added to.
+// Entering the step starts the sub-dialog from its begin step, and messages are handled by the sub-dialog
+// until it reaches its end step. Then the event emitted by the end step's Enter, or DoneEvent,
+// is emitted by this step, so the parent dialog can transition on it.
+//
+// The sub-dialog keeps its own current step of every user, so the same dialog can be reused in several flows,
+// but a dialog must not call itself. Its message hooks and Timeout are not used, its step hooks are.
+// Its memory is cleared on start only if its Namespace is set.
+type SubDialogStep struct {
+	name   string
+	dialog *Dialog
+}
+
+// NewSubDialogStep returns a step named name that runs the dialog.
+func NewSubDialogStep(name string, dialog *Dialog) *SubDialogStep {
+	return &SubDialogStep{name: name, dialog: dialog}
+}
+
+func (s *SubDialogStep) Name() string {
+	return s.name
+}
+
+func (s *SubDialogStep) Enter(bot *Bot, msg *Message) Event {
+	s.dialog.reset(msg.Sender.ID)
+	return s.result(s.dialog.start(bot, msg, s.dialog.Namespace != ""))
+}
+
+func (s *SubDialogStep) Process(bot *Bot, msg *Message) Event {
+	return s.result(s.dialog.handle(bot, msg, s.dialog.Namespace != ""))
+}
+
+// Resume resumes the step the user is at in the sub-dialog, or starts the sub-dialog if he is at none.
+func (s *SubDialogStep) Resume(bot *Bot, msg *Message) Event {
+	step := s.dialog.getStep(msg.Sender.ID)
+	if step == nil || step == s.dialog.endStep {
+		return s.Enter(bot, msg)
+	}
+	return s.result(s.dialog.transition(bot, msg, step, resume(bot, msg, step)))
+}
+
+// Leave forgets the user's step in the sub-dialog, e.g. when the parent dialog is left by a global transition.
+func (s *SubDialogStep) Leave(bot *Bot, msg *Message) Event {
+	s.dialog.reset(msg.Sender.ID)
+	return NilEvent
+}
+
+func (s *SubDialogStep) result(event Event, done bool) Event {
+	if !done {
+		return NilEvent
+	}
+	return event
+}
@@ -0,0 +1,56 @@
+package fbbot
+
+import "testing"
+
+// newChildDialog returns a dialog a -> b -> c, whose end step c emits result when entered.
+func newChildDialog(result Event) (*Dialog, *scriptStep, *scriptStep) {
+	a := &scriptStep{name: "a", process: "next"}
+	b := &scriptStep{name: "b", process: "next"}
+	c := &scriptStep{name: "c", enter: result}
+	child := NewDialog()
+	child.SetBeginStep(a)
+	child.SetEndStep(c)
+	child.AddTransition("next", a, b)
+	child.AddTransition("next", b, c)
+	return child, a, b
+}
+
+func TestSubDialogStepReturns(t *testing.T) {
+	tests := []struct {
+		name   string
+		result Event
+		want   Event
+	}{
+		{"end step event", "approved", "approved"},
+		{"done by default", NilEvent, DoneEvent},
+	}
+	for _, tt := range tests {
+		bot := newTestBot()
+		child, a, b := newChildDialog(tt.result)
+		sub := NewSubDialogStep("sub", child)
+		after, end := &scriptStep{name: "after"}, &scriptStep{name: "end"}
+		d := NewDialog()
+		d.SetBeginStep(sub)
+		d.SetEndStep(end)
+		d.AddTransition(tt.want, sub, after)
+
+		d.HandleMessage(bot, testMessage("u1")) // enters a
+		if got := d.getStep("u1"); got != sub {
+			t.Fatalf("%s: parent step = %v, want the sub-dialog step", tt.name, got)
+		}
+		d.HandleMessage(bot, testMessage("u1")) // a -> b
+		if got := child.getStep("u1"); got != b {
+			t.Fatalf("%s: child step = %v, want b", tt.name, got)
+		}
+		d.HandleMessage(bot, testMessage("u1")) // b -> c, returns
+		if got := d.getStep("u1"); got != after {
+			t.Errorf("%s: parent step after the child ends = %v, want after", tt.name, got)
+		}
+		if got := child.getStep("u1"); got != nil {
+			t.Errorf("%s: child step after it returned = %v, want none", tt.name, got)
+		}
+		if a.processed != 1 || b.processed != 1 {
+			t.Errorf("%s: a and b processed %d and %d messages, want 1 and 1", tt.name, a.processed, b.processed)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package fbbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequiredPermissions are permissions the page access token needs for the bot to work.
+var RequiredPermissions = []string{"pages_messaging", "pages_manage_metadata"}
+
+// TokenProvider provides the page access token.
+// It is called for every Graph API request, so the token can be rotated at runtime.
+type TokenProvider interface {
+	Token() (string, error)
+}
+
+// StaticToken is a page access token that never changes.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// FileToken reads the page access token from a file, e.g. a mounted secret,
+// and reads it again whenever the file is modified.
+type FileToken struct {
+	Path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+func NewFileToken(path string) *FileToken {
+	return &FileToken{Path: path}
+}
+
+func (t *FileToken) Token() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		return "", err
+	}
+	if t.token != "" && info.ModTime().Equal(t.modTime) {
+		return t.token, nil
+	}
+
+	data, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return "", err
+	}
+	t.token = strings.TrimSpace(string(data))
+	t.modTime = info.ModTime()
+	return t.token, nil
+}
+
+// SetTokenProvider replaces the provider of the page access token.
+func (b *Bot) SetTokenProvider(p TokenProvider) {
+	b.tokens = p
+}
+
+// TokenInfo is information about the page access token returned by the debug_token endpoint.
+type TokenInfo struct {
+	AppID     string   `json:"app_id"`
+	Type      string   `json:"type"`
+	IsValid   bool     `json:"is_valid"`
+	ExpiresAt int64    `json:"expires_at"` // Unix time, 0 means never expires
+	Scopes    []string `json:"scopes"`
+}
+
+// DebugToken inspects the page access token.
+func (b *Bot) DebugToken() (*TokenInfo, error) {
+	token, err := b.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	// debug_token only accepts the inspected token as a query parameter
+	body, err := b.httpget(fmt.Sprintf("%s/debug_token?input_token=%s", APIEndpoint, url.QueryEscape(token)))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Data TokenInfo `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// CheckToken returns an error if the page access token is invalid
+// or misses any of RequiredPermissions.
+func (b *Bot) CheckToken() error {
+	info, err := b.DebugToken()
+	if err != nil {
+		return err
+	}
+	if !info.IsValid {
+		return fmt.Errorf("page access token is invalid")
+	}
+
+	granted := make(map[string]bool)
+	for _, scope := range info.Scopes {
+		granted[scope] = true
+	}
+	var missing []string
+	for _, perm := range RequiredPermissions {
+		if !granted[perm] {
+			missing = append(missing, perm)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("page access token misses permissions: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
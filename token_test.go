@@ -0,0 +1,112 @@
+package fbbot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactHook(t *testing.T) {
+	b := New(0, "verify-me", "app-secret", "page-token")
+	var buf bytes.Buffer
+	b.Logger.SetOutput(&buf)
+	b.Logger.SetLevel(logrus.DebugLevel)
+
+	req, err := b.newRequest(context.Background(), "GET", APIEndpoint+"/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := req.URL.Query().Get("appsecret_proof")
+	if proof == "" {
+		t.Fatal("request has no appsecret_proof")
+	}
+
+	entry := b.Logger.WithFields(logrus.Fields{
+		"url":     req.URL.String(),
+		"request": map[string]string{"token": "page-token"},
+		"count":   3,
+	})
+	entry.Errorf("Request with page-token and %s failed", "app-secret")
+	b.Logger.Debugf("Webhook verified by verify-me")
+
+	out := buf.String()
+	for _, secret := range []string{"page-token", "app-secret", "verify-me", proof} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains the secret %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, redacted) || !strings.Contains(out, "count=3") {
+		t.Errorf("log does not keep other data:\n%s", out)
+	}
+	if url, _ := entry.Data["url"].(string); !strings.Contains(url, proof) {
+		t.Errorf("fields of the entry were changed: %q", url)
+	}
+}
+
+func TestFileTokenRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fbbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	token := NewFileToken(path)
+	if _, err := token.Token(); err == nil {
+		t.Error("Token() of a missing file = nil error, want an error")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := token.Token(); err != nil || got != "first" {
+		t.Errorf("Token() = %q, %v, want first", got, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := token.Token(); err != nil || got != "second" {
+		t.Errorf("Token() after rotation = %q, %v, want second", got, err)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		wantErr  string
+	}{
+		{"valid", 200, `{"data":{"is_valid":true,"scopes":["pages_messaging","pages_manage_metadata"]}}`, ""},
+		{"invalid", 200, `{"data":{"is_valid":false}}`, "invalid"},
+		{"missing permission", 200, `{"data":{"is_valid":true,"scopes":["pages_messaging"]}}`, "pages_manage_metadata"},
+		{"request failed", 400, `{"error":{"message":"bad token"}}`, "400"},
+	}
+	for _, tt := range tests {
+		transport := &recordingTransport{Status: tt.status, Response: tt.response}
+		restore := useTransport(transport)
+
+		err := newTestBot().CheckToken()
+		restore()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: CheckToken() = %v, want nil", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: CheckToken() = %v, want an error about %s", tt.name, err, tt.wantErr)
+		}
+		if len(transport.requests) != 1 || transport.requests[0].URL.Query().Get("input_token") != "token" {
+			t.Errorf("%s: CheckToken() did not inspect the page access token", tt.name)
+		}
+	}
+}
@@ -1,68 +1,99 @@
 package fbbot
 
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoBot is returned when profile of an user that is not bound to any bot is requested.
+var ErrNoBot error = errors.New("user is not bound to a bot")
+
 type User struct {
-	ID               string `json:"id"`
-	PhoneNumber      string `json:"phone_number,omitempty"`
-	isFetched        bool
-	firstName        string
-	lastName         string
-	profilePic       string
-	locale           string
-	timezone         float32
-	gender           string
-	isPaymentEnabled bool // Is the user eligible to receive messenger platform payment messages
+	ID          string `json:"id"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+
+	bot      *Bot     // bot that received the user's message, used for fetching the profile
+	platform Platform // platform the user messages from
 }
 
-func (u *User) FirstName() string {
-	if !u.isFetched {
-		bot.fetchUserData(u)
+// Platform returns the platform the user messages from.
+func (u *User) Platform() Platform {
+	if u.platform == "" {
+		return PlatformMessenger
 	}
-	return u.firstName
+	return u.platform
 }
 
-func (u *User) LastName() string {
-	if !u.isFetched {
-		bot.fetchUserData(u)
+// User returns the user with the given ID, bound to the bot.
+// Use it to build a recipient for users that the bot has not received messages from in this process,
+// with WithPlatform for users of Instagram.
+func (b *Bot) User(id string) User {
+	return User{ID: id, bot: b}
+}
+
+// WithPlatform returns the user messaging from the platform, e.g. to send to an Instagram user
+// built by Bot.User.
+func (u User) WithPlatform(platform Platform) User {
+	u.platform = platform
+	return u
+}
+
+// Profile returns profile of the user. Profiles are cached by Bot.Profiles.
+func (u *User) Profile() (Profile, error) {
+	return u.ProfileContext(context.Background())
+}
+
+// ProfileContext is like Profile but stops waiting for the Graph API when ctx is done.
+func (u *User) ProfileContext(ctx context.Context) (Profile, error) {
+	if u.bot == nil {
+		return Profile{}, ErrNoBot
 	}
-	return u.lastName
+	return u.bot.Profiles.Get(ctx, u.ID)
+}
+
+// profile returns profile of the user, or an empty profile if it can not be fetched.
+func (u *User) profile() Profile {
+	p, err := u.Profile()
+	if err != nil {
+		logger := logrus.StandardLogger()
+		if u.bot != nil {
+			logger = u.bot.Logger
+		}
+		logger.WithField("user", u.ID).Error("Failed to get user profile: ", err)
+	}
+	return p
+}
+
+func (u *User) FirstName() string {
+	return u.profile().FirstName
+}
+
+func (u *User) LastName() string {
+	return u.profile().LastName
 }
 
 func (u *User) FullName() string {
-	return u.FirstName() + " " + u.LastName()
+	return u.profile().FullName()
 }
 
 func (u *User) ProfilePic() string {
-	if !u.isFetched {
-		bot.fetchUserData(u)
-	}
-	return u.profilePic
+	return u.profile().ProfilePic
 }
 
 func (u *User) Locale() string {
-	if !u.isFetched {
-		bot.fetchUserData(u)
-	}
-	return u.locale
+	return u.profile().Locale
 }
 
 func (u *User) Timezone() float32 {
-	if !u.isFetched {
-		bot.fetchUserData(u)
-	}
-	return u.timezone
+	return u.profile().Timezone
 }
 
 func (u *User) Gender() string {
-	if !u.isFetched {
-		bot.fetchUserData(u)
-	}
-
-	return u.gender
+	return u.profile().Gender
 }
 
 func (u *User) IsPaymentEnabled() bool {
-	if !u.isFetched {
-		bot.fetchUserData(u)
-	}
-	return u.isPaymentEnabled
+	return u.profile().IsPaymentEnabled
 }